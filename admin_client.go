@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const adminTokenEnv = "INMEMORYTFTP_ADMIN_TOKEN"
+
+const adminUsage = `Usage: inmemorytftp admin [-url URL] [-token TOKEN] COMMAND [ARGS]
+
+Commands:
+  ls [PREFIX]          list files
+  stat NAME            show a file's metadata
+  versions NAME        show the metadata of every version of a file
+  get NAME [LOCAL]     download a file, to stdout if LOCAL isn't given
+  put LOCAL [NAME]     upload a file, named after the last element of LOCAL if NAME isn't given
+  rm NAME              delete a file
+  mv NAME NEWNAME      rename a file
+  rollback NAME VERSION
+                       make an older version of a file the latest again
+  stats                summarise the store
+  transfers            list the transfers in progress
+  cancel SESSION       cancel a transfer, given its session id
+  reload               reload the server's configuration
+`
+
+// runAdminClient runs one admin command against a server's admin API, returning the exit code
+func runAdminClient(args []string) int {
+	opts := flag.NewFlagSet("inmemorytftp admin", flag.ContinueOnError)
+	opts.Usage = func() {
+		fmt.Fprint(opts.Output(), adminUsage)
+		opts.PrintDefaults()
+	}
+	baseURL := opts.String("url", "http://localhost:8069", "Address of the server's admin API")
+	token := opts.String("token", os.Getenv(adminTokenEnv), "Bearer token for the admin API. Defaults to $"+adminTokenEnv)
+	if err := opts.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	client := adminClient{baseURL: strings.TrimSuffix(*baseURL, "/"), token: *token}
+	if err := client.run(opts.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if err == errUsage {
+			opts.Usage()
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+var errUsage = fmt.Errorf("invalid command")
+
+type adminClient struct {
+	baseURL string
+	token   string
+}
+
+func (client adminClient) run(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	command, args := args[0], args[1:]
+	switch {
+	case command == "ls" && len(args) <= 1:
+		return client.list(strings.Join(args, ""))
+	case command == "stat" && len(args) == 1:
+		return client.printJSON(http.MethodGet, "/api/stat/"+url.PathEscape(args[0]), nil)
+	case command == "versions" && len(args) == 1:
+		return client.printJSON(http.MethodGet, "/api/versions/"+url.PathEscape(args[0]), nil)
+	case command == "get" && (len(args) == 1 || len(args) == 2):
+		return client.get(args[0], args[1:])
+	case command == "put" && (len(args) == 1 || len(args) == 2):
+		return client.put(args[0], args[1:])
+	case command == "rm" && len(args) == 1:
+		return client.printJSON(http.MethodDelete, "/api/files/"+url.PathEscape(args[0]), nil)
+	case command == "mv" && len(args) == 2:
+		body, _ := json.Marshal(map[string]string{"to": args[1]})
+		return client.printJSON(http.MethodPost, "/api/rename/"+url.PathEscape(args[0]), bytes.NewReader(body))
+	case command == "rollback" && len(args) == 2:
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return errUsage
+		}
+		body, _ := json.Marshal(map[string]int{"version": version})
+		return client.printJSON(http.MethodPost, "/api/rollback/"+url.PathEscape(args[0]), bytes.NewReader(body))
+	case command == "stats" && len(args) == 0:
+		return client.printJSON(http.MethodGet, "/api/stats", nil)
+	case command == "transfers" && len(args) == 0:
+		return client.printJSON(http.MethodGet, "/api/transfers", nil)
+	case command == "cancel" && len(args) == 1:
+		return client.printJSON(http.MethodDelete, "/api/transfers/"+url.PathEscape(args[0]), nil)
+	case command == "reload" && len(args) == 0:
+		return client.printJSON(http.MethodPost, "/api/reload", nil)
+	}
+	return errUsage
+}
+
+func (client adminClient) list(prefix string) error {
+	after := ""
+	for {
+		query := url.Values{"prefix": {prefix}}
+		if after != "" {
+			query.Set("after", after)
+		}
+		res, err := client.do(http.MethodGet, "/api/files?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		var page struct {
+			Files []struct {
+				Name     string `json:"name"`
+				Version  int    `json:"version"`
+				Size     int64  `json:"size"`
+				Modified string `json:"modified"`
+			} `json:"files"`
+			Next string `json:"next"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, f := range page.Files {
+			fmt.Printf("%12d  v%-4d %s  %s\n", f.Size, f.Version, f.Modified, f.Name)
+		}
+		if page.Next == "" {
+			return nil
+		}
+		after = page.Next
+	}
+}
+
+func (client adminClient) get(name string, local []string) error {
+	res, err := client.do(http.MethodGet, "/api/files/"+url.PathEscape(name), nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if len(local) == 0 {
+		_, err = io.Copy(os.Stdout, res.Body)
+		return err
+	}
+	f, err := os.Create(local[0])
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, res.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (client adminClient) put(local string, name []string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	target := filepath.Base(local)
+	if len(name) > 0 {
+		target = name[0]
+	}
+	return client.printJSON(http.MethodPut, "/api/files/"+url.PathEscape(target), f)
+}
+
+func (client adminClient) printJSON(method string, path string, body io.Reader) error {
+	res, err := client.do(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, err = io.Copy(os.Stdout, res.Body)
+	return err
+}
+
+// do sends a request, turning error responses into errors
+func (client adminClient) do(method string, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, client.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if client.token != "" {
+		req.Header.Set("Authorization", "Bearer "+client.token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&failure)
+		return nil, fmt.Errorf("%s: %s", res.Status, failure.Error)
+	}
+	return res, nil
+}
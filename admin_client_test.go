@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/sblundy/inmemorytftp/server/admin"
+	"github.com/sblundy/inmemorytftp/server/store"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdminClient_PutDefaultsToBaseName(t *testing.T) {
+	files := store.New()
+	api := httptest.NewServer(admin.New(files))
+	defer api.Close()
+	local := filepath.Join(t.TempDir(), "a.img")
+	os.WriteFile(local, []byte("image"), 0644)
+	sut := adminClient{baseURL: api.URL}
+
+	if err := sut.run([]string{"put", local}); err != nil {
+		t.Fatal("Put failed", err)
+	}
+
+	if contents, prs := files.Get("a.img"); !prs || string(contents) != "image" {
+		t.Error("Expected file stored under its base name", files.Stats())
+	}
+}
+
+func TestAdminClient_LeadingSlash(t *testing.T) {
+	files := store.New()
+	api := httptest.NewServer(admin.New(files))
+	defer api.Close()
+	local := filepath.Join(t.TempDir(), "pxelinux.0")
+	os.WriteFile(local, []byte("pxelinux"), 0644)
+	sut := adminClient{baseURL: api.URL}
+
+	if err := sut.run([]string{"put", local, "/pxelinux.0"}); err != nil {
+		t.Fatal("Put failed", err)
+	}
+	if _, prs := files.Stat("/pxelinux.0"); !prs {
+		t.Fatal("Expected file stored with its leading slash", files.Stats())
+	}
+	fetched := filepath.Join(t.TempDir(), "fetched")
+	if err := sut.run([]string{"get", "/pxelinux.0", fetched}); err != nil {
+		t.Error("Get failed", err)
+	}
+	if contents, _ := os.ReadFile(fetched); string(contents) != "pxelinux" {
+		t.Error("Downloaded contents incorrect", string(contents))
+	}
+	if err := sut.run([]string{"rm", "/pxelinux.0"}); err != nil {
+		t.Error("Delete failed", err)
+	}
+}
+
+func TestAdminClient_Rollback(t *testing.T) {
+	files := store.New(store.WithHistory(5, 0))
+	files.Put("boot.cfg", []byte("first"))
+	files.Put("boot.cfg", []byte("second"))
+	api := httptest.NewServer(admin.New(files))
+	defer api.Close()
+	sut := adminClient{baseURL: api.URL}
+
+	if err := sut.run([]string{"rollback", "boot.cfg", "1"}); err != nil {
+		t.Fatal("Rollback failed", err)
+	}
+
+	if contents, _ := files.Get("boot.cfg"); string(contents) != "first" {
+		t.Error("Expected first version restored", string(contents))
+	}
+	if err := sut.run([]string{"rollback", "boot.cfg", "one"}); err != errUsage {
+		t.Error("Expected usage error for a version that isn't a number", err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"github.com/sblundy/inmemorytftp/server/acl"
+	"github.com/sblundy/inmemorytftp/server/config"
+)
+
+// envPrefix starts the name of the environment variable each flag can be set by, e.g. INMEMORYTFTP_MAX_SESSIONS
+const envPrefix = "INMEMORYTFTP"
+
+// configKeys maps each key of the config file, as table.key, to the flag it sets
+var configKeys = map[string]string{
+	"server.port":                "port",
+	"server.listen":              "listen",
+	"server.run_check_interval":  "run-check-interval",
+	"server.max_sessions":        "max-sessions",
+	"transfer.block_timeout":     "block-timeout",
+	"transfer.ack_timeout":       "ack-timeout",
+	"transfer.data_timeout":      "data-timeout",
+	"transfer.retries":           "retries",
+	"store.backend":              "store-backend",
+	"store.snapshot":             "snapshot",
+	"store.journal":              "journal",
+	"store.journal_compact_size": "journal-compact-size",
+	"store.history":              "history",
+	"store.history_max_bytes":    "history-max-bytes",
+	"store.compress":             "compress",
+	"store.memory_budget":        "memory-budget",
+	"store.ttl":                  "ttl",
+	"store.ttl_prefix":           "ttl-prefix",
+	"store.mirror":               "mirror",
+	"preload.dir":                "preload",
+	"preload.include":            "preload-include",
+	"preload.exclude":            "preload-exclude",
+	"preload.max_size":           "preload-max-size",
+	"preload.watch":              "watch",
+	"preload.watch_debounce":     "watch-debounce",
+	"hooks.on_upload":            "on-upload",
+	"hooks.on_download":          "on-download",
+	"hooks.timeout":              "hook-timeout",
+	"hooks.concurrency":          "hook-concurrency",
+	"webhooks.urls":              "webhook",
+	"webhooks.secret":            "webhook-secret",
+	"webhooks.attempts":          "webhook-attempts",
+	"webhooks.backoff":           "webhook-backoff",
+	"logging.level":              "log-level",
+	"logging.format":             "log-format",
+	"logging.audit":              "audit-log",
+	"logging.audit_max_size":     "audit-log-max-size",
+	"logging.audit_max_backups":  "audit-log-max-backups",
+	"tracing.exporter":           "trace",
+	"tracing.endpoint":           "trace-endpoint",
+	"admin.addr":                 "admin-addr",
+	"admin.token":                "admin-token",
+	"acl.default":                "acl-default",
+}
+
+// aclRuleTable is the array of tables in the config file holding the ACL's rules, in order
+const aclRuleTable = "acl.rule"
+
+// applyConfig sets every flag not given on the command line from its environment variable, then from the config file
+// at *configPath, if there is one. The file is returned so the ACL rules can be read from it.
+func applyConfig(opts *flag.FlagSet, configPath *string) (*config.File, error) {
+	set := map[string]bool{}
+	opts.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if err := config.ApplyEnv(opts, envPrefix, set); err != nil {
+		return nil, err
+	}
+	if *configPath == "" {
+		return nil, nil
+	}
+	file, err := config.Load(*configPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Apply(opts, configKeys, set, aclRuleTable); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// newACL builds the ACL from the [[acl.rule]] tables of file, which may be nil, and the -acl-default flag. It returns
+// nil when there's nothing to enforce.
+func newACL(file *config.File, defaultAction string) (*acl.ACL, error) {
+	list := &acl.ACL{DefaultAllow: defaultAction == "allow"}
+	if file != nil {
+		for _, table := range file.Array(aclRuleTable) {
+			rule, err := aclRule(file, table)
+			if err != nil {
+				return nil, err
+			}
+			list.Rules = append(list.Rules, rule)
+		}
+	}
+	if len(list.Rules) == 0 && list.DefaultAllow {
+		return nil, nil
+	}
+	return list, nil
+}
+
+func aclRule(file *config.File, table *config.Table) (acl.Rule, error) {
+	var action, direction, prefix string
+	var clients []string
+	for _, key := range table.Keys() {
+		value := table.Values[key]
+		var ok bool
+		switch key {
+		case "action":
+			action, ok = value.Value.(string)
+		case "direction":
+			direction, ok = value.Value.(string)
+		case "prefix":
+			prefix, ok = value.Value.(string)
+		case "clients":
+			clients, ok = stringArray(value.Value)
+		default:
+			return acl.Rule{}, file.Errorf(value.Line, aclRuleTable+"."+key, "unknown key")
+		}
+		if !ok {
+			return acl.Rule{}, file.Errorf(value.Line, aclRuleTable+"."+key, "expected %s", expectedType(key))
+		}
+	}
+	rule, err := acl.NewRule(action, clients, direction, prefix)
+	if err != nil {
+		return acl.Rule{}, file.Errorf(table.Line, aclRuleTable, "%v", err)
+	}
+	return rule, nil
+}
+
+func stringArray(value interface{}) ([]string, bool) {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	strs := make([]string, len(items))
+	for i, item := range items {
+		if strs[i], ok = item.(string); !ok {
+			return nil, false
+		}
+	}
+	return strs, true
+}
+
+func expectedType(key string) string {
+	if key == "clients" {
+		return "an array of strings"
+	}
+	return "a string"
+}
@@ -1,17 +1,38 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/sblundy/inmemorytftp/server"
+	"github.com/sblundy/inmemorytftp/server/admin"
+	"github.com/sblundy/inmemorytftp/server/audit"
+	"github.com/sblundy/inmemorytftp/server/health"
+	"github.com/sblundy/inmemorytftp/server/hook"
+	"github.com/sblundy/inmemorytftp/server/metrics"
+	"github.com/sblundy/inmemorytftp/server/preload"
+	"github.com/sblundy/inmemorytftp/server/store"
+	"github.com/sblundy/inmemorytftp/server/tracing"
+	"github.com/sblundy/inmemorytftp/server/watch"
+	"github.com/sblundy/inmemorytftp/server/webhook"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 func main() {
-	opts := flag.NewFlagSet("inmemorytftp", flag.ContinueOnError)
-	port := opts.Uint("port", 69, "Port to listen for connections")
-	err := opts.Parse(os.Args[1:])
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(runAdminClient(os.Args[2:]))
+	}
+	flags := flag.NewFlagSet("inmemorytftp", flag.ContinueOnError)
+	cfg := defineOptions(flags)
+	err := flags.Parse(os.Args[1:])
 	if err != nil {
 		switch err {
 		default:
@@ -20,7 +41,344 @@ func main() {
 			return
 		}
 	}
-	fmt.Printf("Listening on %d\n", *port)
-	service := server.New(*port, 10*time.Second)
-	service.Listen()
+	if err := cfg.resolve(flags); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	level, err := parseLevel(cfg.logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(level)
+	logger, err := newLogger(logLevel, cfg.logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	storeOpts := []store.Option{store.WithHistory(cfg.historyVersions, cfg.historyMaxBytes)}
+	if cfg.compress {
+		storeOpts = append(storeOpts, store.WithCompression())
+	}
+	if cfg.memoryBudget > 0 {
+		storeOpts = append(storeOpts, store.WithMemoryBudget(cfg.memoryBudget))
+	}
+	if cfg.ttl > 0 {
+		storeOpts = append(storeOpts, store.WithTTL("", cfg.ttl))
+	}
+	for _, rule := range cfg.prefixTTLs {
+		storeOpts = append(storeOpts, store.WithTTL(rule.prefix, rule.ttl))
+	}
+	var journal *store.Journal
+	if cfg.journalPath != "" {
+		journal, err = store.OpenJournal(cfg.journalPath)
+		if err != nil {
+			fatal("Unable to open journal", "path", cfg.journalPath, "error", err)
+		}
+		defer journal.Close()
+		storeOpts = append(storeOpts, store.WithJournal(journal, cfg.snapshot, cfg.compactSize))
+	}
+
+	files := store.New(storeOpts...)
+
+	registry := metrics.NewRegistry()
+	serverOpts := []server.Option{server.WithStore(files), server.WithMetrics(registry), server.WithLogger(logger)}
+	if cfg.mirrorDir != "" {
+		serverOpts = append(serverOpts, server.WithMirror(cfg.mirrorDir))
+	}
+	if cfg.auditPath != "" {
+		auditLog, err := audit.Open(cfg.auditPath, cfg.auditMaxSize, cfg.auditMaxBackups)
+		if err != nil {
+			fatal("Unable to open audit log", "path", cfg.auditPath, "error", err)
+		}
+		defer auditLog.Close()
+		serverOpts = append(serverOpts, server.WithAuditLog(auditLog))
+	}
+	var tracer *tracing.Tracer
+	switch cfg.traceExporter {
+	case "":
+	case "stdout":
+		tracer = tracing.New(tracing.NewWriterExporter(os.Stdout), tracing.WithResource(tracing.String("service.name", "inmemorytftp")))
+	case "otlp":
+		tracer = tracing.New(tracing.NewOTLPExporter(cfg.traceEndpoint, nil), tracing.WithResource(tracing.String("service.name", "inmemorytftp")))
+	default:
+		fatal("Unknown trace exporter", "trace", cfg.traceExporter)
+	}
+	if tracer != nil {
+		serverOpts = append(serverOpts, server.WithTracer(tracer))
+	}
+	var notifier *webhook.Notifier
+	if len(cfg.webhookURLs) > 0 {
+		hookOpts := []webhook.Option{webhook.WithRetries(cfg.webhookAttempts, cfg.webhookBackoff)}
+		if cfg.webhookSecret != "" {
+			hookOpts = append(hookOpts, webhook.WithSecret(cfg.webhookSecret))
+		}
+		notifier = webhook.New(cfg.webhookURLs, hookOpts...)
+		serverOpts = append(serverOpts, server.WithObserver(notifier.Observe))
+	}
+	var hooks *hook.Runner
+	if cfg.onUpload != "" || cfg.onDownload != "" {
+		hooks = hook.New(files, hook.OnUpload(cfg.onUpload), hook.OnDownload(cfg.onDownload),
+			hook.WithTimeout(cfg.hookTimeout), hook.WithConcurrency(cfg.hookConcurrency))
+		serverOpts = append(serverOpts, server.WithObserver(hooks.Observe))
+	}
+	if len(cfg.listenAddrs) > 0 {
+		serverOpts = append(serverOpts, server.WithListenAddrs(cfg.listenAddrs...))
+	}
+	service := server.New(cfg.port, cfg.runCheckFreq, serverOpts...)
+	service.Reconfigure(cfg.settings())
+	reloads := &reloader{args: os.Args[1:], flags: flags, service: &service, files: files, level: logLevel}
+
+	// The admin API is served while the store loads, so health checks can tell an orchestrator it isn't ready yet. A
+	// failure to load or to bind the TFTP ports is fatal, so the store doesn't need a liveness check, and the TFTP
+	// ports are only checked once they've been bound
+	var loaded atomic.Bool
+	checks := health.New()
+	checks.AddLiveness("tftp", func() error {
+		if loaded.Load() && !service.Listening() {
+			return errors.New("not listening on every UDP address")
+		}
+		return nil
+	})
+	checks.AddReadiness("store", func() error {
+		if !loaded.Load() {
+			return errors.New("still loading")
+		}
+		return nil
+	})
+	checks.AddReadiness("sessions", func() error {
+		if !service.HasCapacity() {
+			return fmt.Errorf("all %d sessions in use", service.Settings().MaxSessions)
+		}
+		return nil
+	})
+
+	var adminServer *http.Server
+	if cfg.adminAddr != "" {
+		adminOpts := []admin.Option{admin.WithTransfers(&service), admin.WithReloader(reloads)}
+		if cfg.adminToken != "" {
+			adminOpts = append(adminOpts, admin.WithToken(cfg.adminToken))
+		}
+		adminAPI := admin.New(files, adminOpts...)
+		adminAPI.Handle("/metrics", registry)
+		adminAPI.HandleUnauthenticated("/healthz", checks.LivenessHandler())
+		adminAPI.HandleUnauthenticated("/readyz", checks.ReadinessHandler())
+		adminServer = &http.Server{Addr: cfg.adminAddr, Handler: untilLoaded(&loaded, adminAPI)}
+		go func() {
+			if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				fatal("Unable to serve admin API", "addr", cfg.adminAddr, "error", err)
+			}
+		}()
+		slog.Info("Serving admin API", "addr", cfg.adminAddr)
+	}
+
+	if cfg.snapshot != "" {
+		loadSnapshot(files, cfg.snapshot)
+	}
+	if journal != nil {
+		if err := files.ReplayJournal(journal); err != nil {
+			fatal("Unable to replay journal", "path", cfg.journalPath, "error", err)
+		}
+	}
+	if cfg.preloadDir != "" {
+		n, err := preload.Load(cfg.preloadDir, files, cfg.preloadOpts)
+		if err != nil {
+			fatal("Unable to preload", "dir", cfg.preloadDir, "error", err)
+		}
+		slog.Info("Preloaded files", "count", n, "dir", cfg.preloadDir)
+	}
+	if cfg.watchPreload {
+		reloads.watcher, err = watch.Start(cfg.preloadDir, files, cfg.preloadOpts, cfg.watchDebounce)
+		if err != nil {
+			fatal("Unable to watch", "dir", cfg.preloadDir, "error", err)
+		}
+	}
+	defer reloads.stop()
+
+	stats := files.Stats()
+	slog.Info("Store loaded", "files", stats.Files, "bytes", stats.LogicalBytes, "memory", stats.PhysicalBytes,
+		"compressionRatio", stats.CompressionRatio)
+	if err := service.Bind(); err != nil {
+		fatal("Unable to listen", "error", err)
+	}
+	loaded.Store(true)
+
+	slog.Info("Listening", "port", cfg.port, "listen", cfg.listenAddrs.String())
+	go service.Serve()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	if len(snapshotSignals) > 0 {
+		signal.Notify(signals, snapshotSignals...)
+	}
+	if len(reloadSignals) > 0 {
+		signal.Notify(signals, reloadSignals...)
+	}
+	for sig := range signals {
+		if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+			break
+		}
+		if isOneOf(sig, reloadSignals) {
+			if err := reloads.Reload(); err != nil {
+				slog.Error("Unable to reload configuration", "error", err)
+			}
+			continue
+		}
+		if cfg.snapshot != "" {
+			saveSnapshot(files, cfg.snapshot)
+		}
+	}
+
+	slog.Info("Shutting down")
+	if adminServer != nil {
+		adminServer.Close()
+	}
+	service.Stop()
+	if notifier != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := notifier.Shutdown(ctx); err != nil {
+			slog.Warn("Webhook notifications abandoned on shutdown", "error", err)
+		}
+		cancel()
+	}
+	if tracer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := tracer.Shutdown(ctx); err != nil {
+			slog.Warn("Spans dropped on shutdown", "error", err)
+		}
+		cancel()
+	}
+	if hooks != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.hookTimeout)
+		if err := hooks.Shutdown(ctx); err != nil {
+			slog.Warn("Hooks killed on shutdown", "error", err)
+		}
+		cancel()
+	}
+	if cfg.snapshot != "" {
+		saveSnapshot(files, cfg.snapshot)
+	}
+}
+
+// untilLoaded answers requests to the admin API with 503 until the store has loaded, so nothing uploaded is
+// overwritten by the snapshot or preloaded files. Health checks and metrics are served throughout.
+func untilLoaded(loaded *atomic.Bool, adminAPI http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !loaded.Load() && strings.HasPrefix(r.URL.Path, "/api/") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, `{"error":"store still loading"}`)
+			return
+		}
+		adminAPI.ServeHTTP(w, r)
+	})
+}
+
+func loadSnapshot(files store.Store, path string) {
+	err := files.LoadSnapshot(path)
+	switch {
+	case err == nil:
+		slog.Info("Snapshot loaded", "path", path)
+	case os.IsNotExist(err):
+		slog.Info("No snapshot found", "path", path)
+	default:
+		fatal("Unable to load snapshot", "path", path, "error", err)
+	}
+}
+
+func saveSnapshot(files store.Store, path string) {
+	if err := files.SaveSnapshot(path); err != nil {
+		slog.Error("Unable to save snapshot", "path", path, "error", err)
+	} else {
+		slog.Info("Snapshot saved", "path", path)
+	}
+}
+
+// parseLevel parses -log-level
+func parseLevel(level string) (slog.Level, error) {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return 0, fmt.Errorf("invalid -log-level %q", level)
+	}
+	return minLevel, nil
+}
+
+// newLogger builds the logger everything logs to, writing to stderr. The level can be changed while it's in use
+func newLogger(level *slog.LevelVar, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid -log-format %q, expected text or json", format)
+}
+
+// isOneOf returns whether sig is in signals
+func isOneOf(sig os.Signal, signals []os.Signal) bool {
+	for _, s := range signals {
+		if sig == s {
+			return true
+		}
+	}
+	return false
+}
+
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// stringList is a flag that can be repeated, collecting every value
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+func (list *stringList) IsList() bool {
+	return true
+}
+
+// ttlList is a repeatable flag of prefix=duration pairs
+type ttlList []prefixTTL
+
+type prefixTTL struct {
+	prefix string
+	ttl    time.Duration
+}
+
+func (list *ttlList) String() string {
+	rules := make([]string, len(*list))
+	for i, rule := range *list {
+		rules[i] = fmt.Sprintf("%s=%s", rule.prefix, rule.ttl)
+	}
+	return strings.Join(rules, ",")
+}
+
+func (list *ttlList) Set(value string) error {
+	i := strings.LastIndexByte(value, '=')
+	if i < 0 {
+		return fmt.Errorf("expected prefix=duration, got %q", value)
+	}
+	ttl, err := time.ParseDuration(value[i+1:])
+	if err != nil {
+		return err
+	}
+	*list = append(*list, prefixTTL{prefix: value[:i], ttl: ttl})
+	return nil
+}
+
+func (list *ttlList) IsList() bool {
+	return true
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sblundy/inmemorytftp/server"
+	"github.com/sblundy/inmemorytftp/server/acl"
+	"github.com/sblundy/inmemorytftp/server/config"
+	"github.com/sblundy/inmemorytftp/server/preload"
+	"github.com/sblundy/inmemorytftp/server/tracing"
+	"strings"
+	"time"
+)
+
+// options are the server's settings, from its flags, environment variables and config file
+type options struct {
+	configPath      string
+	port            uint
+	listenAddrs     stringList
+	runCheckFreq    time.Duration
+	blockTimeout    time.Duration
+	ackTimeout      time.Duration
+	dataTimeout     time.Duration
+	retries         int
+	storeBackend    string
+	snapshot        string
+	journalPath     string
+	compactSize     int64
+	historyVersions int
+	historyMaxBytes int64
+	compress        bool
+	memoryBudget    int64
+	ttl             time.Duration
+	prefixTTLs      ttlList
+	preloadDir      string
+	preloadOpts     preload.Options
+	watchPreload    bool
+	mirrorDir       string
+	watchDebounce   time.Duration
+	adminAddr       string
+	logLevel        string
+	logFormat       string
+	auditPath       string
+	auditMaxSize    int64
+	auditMaxBackups int
+	webhookURLs     stringList
+	webhookSecret   string
+	webhookAttempts int
+	webhookBackoff  time.Duration
+	onUpload        string
+	onDownload      string
+	hookTimeout     time.Duration
+	hookConcurrency int
+	traceExporter   string
+	traceEndpoint   string
+	maxSessions     int
+	adminToken      string
+	aclDefault      string
+	// acl is built from -acl-default and the rules in the config file. Nil if every request is allowed
+	acl *acl.ACL
+}
+
+// defineOptions adds a flag for each option to flags
+func defineOptions(flags *flag.FlagSet) *options {
+	o := &options{}
+	flags.StringVar(&o.configPath, "config", "", "TOML file to read settings from. Flags and environment variables override it")
+	flags.UintVar(&o.port, "port", 69, "Port to listen for connections")
+	flags.Var(&o.listenAddrs, "listen", "Address to listen for connections on, e.g. 192.0.2.1:69. May be repeated. Defaults to -port on every interface")
+	flags.DurationVar(&o.runCheckFreq, "run-check-interval", 10*time.Second, "How often listeners check whether the server is stopping")
+	flags.DurationVar(&o.blockTimeout, "block-timeout", server.DefaultTimeouts.Block, "How long to keep resending a block before giving up on the transfer")
+	flags.DurationVar(&o.ackTimeout, "ack-timeout", server.DefaultTimeouts.Ack, "How long to wait for an ACK before resending a block")
+	flags.DurationVar(&o.dataTimeout, "data-timeout", server.DefaultTimeouts.Data, "How long to wait for a DATA packet before resending the last ACK")
+	flags.IntVar(&o.retries, "retries", server.DefaultTimeouts.Retries, "Number of times to resend a packet before giving up on the transfer. 0 for no limit besides -block-timeout")
+	choiceVar(flags, &o.storeBackend, "store-backend", "memory", "Where files are held. Only memory is supported", "memory")
+	flags.StringVar(&o.snapshot, "snapshot", "", "Snapshot file to load at startup and save to on shutdown")
+	flags.StringVar(&o.journalPath, "journal", "", "Journal file recording every upload before it is acknowledged. Requires -snapshot")
+	flags.Int64Var(&o.compactSize, "journal-compact-size", 64<<20, "Journal size in bytes at which it is compacted into the snapshot")
+	flags.IntVar(&o.historyVersions, "history", 0, "Number of older versions of each file to keep")
+	flags.Int64Var(&o.historyMaxBytes, "history-max-bytes", 0, "Total size in bytes of older versions to keep. 0 for no limit")
+	flags.BoolVar(&o.compress, "compress", false, "Hold files compressed in memory when it saves space")
+	flags.Int64Var(&o.memoryBudget, "memory-budget", 0, "Evict the least recently read files once the store uses more than this many bytes. 0 for no limit")
+	flags.DurationVar(&o.ttl, "ttl", 0, "Expire files this long after they were stored. 0 for never")
+	flags.Var(&o.prefixTTLs, "ttl-prefix", "Expire files starting with a prefix, given as prefix=duration. May be repeated")
+	flags.StringVar(&o.preloadDir, "preload", "", "Directory to load into the store at startup")
+	flags.Var((*stringList)(&o.preloadOpts.Include), "preload-include", "Only preload files matching this glob pattern. May be repeated")
+	flags.Var((*stringList)(&o.preloadOpts.Exclude), "preload-exclude", "Don't preload files matching this glob pattern. May be repeated")
+	flags.Int64Var(&o.preloadOpts.MaxSize, "preload-max-size", 0, "Skip preloading files larger than this many bytes. 0 for no limit")
+	flags.BoolVar(&o.watchPreload, "watch", false, "Keep the store in sync with the -preload directory as files change")
+	flags.StringVar(&o.mirrorDir, "mirror", "", "Directory to write a copy of every uploaded file to")
+	flags.DurationVar(&o.watchDebounce, "watch-debounce", 2*time.Second, "How long a watched file must be unchanged before it is stored")
+	flags.StringVar(&o.adminAddr, "admin-addr", "", "Address to serve the HTTP admin API on, e.g. localhost:8069. Disabled if empty")
+	flags.StringVar(&o.logLevel, "log-level", "info", "Least severe log messages to write: debug, info, warn or error")
+	choiceVar(flags, &o.logFormat, "log-format", "text", "Format of log messages: text or json", "text", "json")
+	flags.StringVar(&o.auditPath, "audit-log", "", "File to write an audit record of every transfer to, or - for stdout")
+	flags.Int64Var(&o.auditMaxSize, "audit-log-max-size", 100<<20, "Size in bytes at which the audit log is rotated. 0 to never rotate")
+	flags.IntVar(&o.auditMaxBackups, "audit-log-max-backups", 5, "Number of rotated audit logs to keep")
+	flags.Var(&o.webhookURLs, "webhook", "URL to POST a notification to whenever a file is uploaded. May be repeated")
+	flags.StringVar(&o.webhookSecret, "webhook-secret", "", "Secret to sign webhook notifications with")
+	flags.IntVar(&o.webhookAttempts, "webhook-attempts", 5, "Number of times to try delivering each webhook notification")
+	flags.DurationVar(&o.webhookBackoff, "webhook-backoff", time.Second, "How long to wait before retrying a webhook notification, doubled for each retry")
+	flags.StringVar(&o.onUpload, "on-upload", "", "Command to run after each upload, given the file on stdin and its metadata in the environment")
+	flags.StringVar(&o.onDownload, "on-download", "", "Command to run after each download, given the file on stdin and its metadata in the environment")
+	flags.DurationVar(&o.hookTimeout, "hook-timeout", 30*time.Second, "How long -on-upload and -on-download commands may run before they're killed")
+	flags.IntVar(&o.hookConcurrency, "hook-concurrency", 4, "Number of -on-upload and -on-download commands that may run at once")
+	flags.StringVar(&o.traceExporter, "trace", "", "Export a trace of each transfer: stdout or otlp. Disabled if empty")
+	flags.StringVar(&o.traceEndpoint, "trace-endpoint", tracing.DefaultOTLPEndpoint, "OTLP/HTTP endpoint to export traces to with -trace otlp")
+	flags.IntVar(&o.maxSessions, "max-sessions", 0, "Refuse requests while this many transfers are in progress. 0 for no limit")
+	flags.StringVar(&o.adminToken, "admin-token", "", "Bearer token required by the admin API")
+	choiceVar(flags, &o.aclDefault, "acl-default", "allow", "Whether to allow or deny requests no ACL rule in the config file matches", "allow", "deny")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage of %s:\n", flags.Name())
+		flags.PrintDefaults()
+		fmt.Fprintf(flags.Output(), "\nEvery flag can also be set by an environment variable, e.g. -max-sessions by $%s.\n",
+			config.EnvName(envPrefix, "max-sessions"))
+	}
+	return o
+}
+
+// resolve fills in the options not given on the command line, once flags has parsed it
+func (o *options) resolve(flags *flag.FlagSet) error {
+	configFile, err := applyConfig(flags, &o.configPath)
+	if err != nil {
+		return err
+	}
+	if o.acl, err = newACL(configFile, o.aclDefault); err != nil {
+		return err
+	}
+	if o.watchPreload && o.preloadDir == "" {
+		return errors.New("-watch requires -preload")
+	}
+	if o.journalPath != "" && o.snapshot == "" {
+		return errors.New("-journal requires -snapshot")
+	}
+	return nil
+}
+
+// settings returns the options the TFTP server can change while it runs
+func (o *options) settings() server.Settings {
+	return server.Settings{
+		ACL:         o.acl,
+		MaxSessions: o.maxSessions,
+		Timeouts: server.Timeouts{
+			Block:   o.blockTimeout,
+			Ack:     o.ackTimeout,
+			Data:    o.dataTimeout,
+			Retries: o.retries,
+		},
+	}
+}
+
+// choice is a flag that must be one of a fixed set of values
+type choice struct {
+	value   *string
+	choices []string
+}
+
+func choiceVar(flags *flag.FlagSet, value *string, name string, defaultValue string, usage string, choices ...string) {
+	*value = defaultValue
+	flags.Var(&choice{value: value, choices: choices}, name, usage)
+}
+
+func (c *choice) String() string {
+	if c.value == nil {
+		return ""
+	}
+	return *c.value
+}
+
+func (c *choice) Set(value string) error {
+	for _, allowed := range c.choices {
+		if value == allowed {
+			*c.value = value
+			return nil
+		}
+	}
+	return fmt.Errorf("expected %s", strings.Join(c.choices, " or "))
+}
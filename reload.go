@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"github.com/sblundy/inmemorytftp/server"
+	"github.com/sblundy/inmemorytftp/server/preload"
+	"github.com/sblundy/inmemorytftp/server/store"
+	"github.com/sblundy/inmemorytftp/server/watch"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// reloadableFlags are the options a reload applies. Changes to any other need a restart
+var reloadableFlags = map[string]bool{
+	"acl-default":      true,
+	"max-sessions":     true,
+	"block-timeout":    true,
+	"ack-timeout":      true,
+	"data-timeout":     true,
+	"retries":          true,
+	"log-level":        true,
+	"preload":          true,
+	"preload-include":  true,
+	"preload-exclude":  true,
+	"preload-max-size": true,
+	"watch":            true,
+	"watch-debounce":   true,
+}
+
+// preloadFlags are the options that decide which files are preloaded
+var preloadFlags = []string{"preload", "preload-include", "preload-exclude", "preload-max-size"}
+
+// reloader re-reads the options from the command line, environment and config file, and applies those in
+// reloadableFlags to the running server. The store and transfers in progress are untouched.
+type reloader struct {
+	lock sync.Mutex
+	args []string
+	// flags hold the options last applied
+	flags   *flag.FlagSet
+	service *server.TftpServer
+	files   store.Store
+	level   *slog.LevelVar
+	// watcher keeps the store in sync with the preload directory. Nil unless -watch is set
+	watcher *watch.Watcher
+}
+
+// Reload applies the options as they are now. If the options are invalid, nothing is changed.
+func (r *reloader) Reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	flags := flag.NewFlagSet("inmemorytftp", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	cfg := defineOptions(flags)
+	if err := flags.Parse(r.args); err != nil {
+		return err
+	}
+	if err := cfg.resolve(flags); err != nil {
+		return err
+	}
+	level, err := parseLevel(cfg.logLevel)
+	if err != nil {
+		return err
+	}
+
+	// The steps that can fail come first, so a failure leaves the running configuration and watcher as they were
+	preloadChanged := changed(r.flags, flags, preloadFlags...)
+	if preloadChanged && cfg.preloadDir != "" {
+		n, err := preload.Load(cfg.preloadDir, r.files, cfg.preloadOpts)
+		if err != nil {
+			return err
+		}
+		slog.Info("Preloaded files", "count", n, "dir", cfg.preloadDir)
+	}
+	rewatch := preloadChanged || changed(r.flags, flags, "watch", "watch-debounce")
+	var watcher *watch.Watcher
+	if rewatch && cfg.watchPreload {
+		if watcher, err = watch.Start(cfg.preloadDir, r.files, cfg.preloadOpts, cfg.watchDebounce); err != nil {
+			return err
+		}
+	}
+
+	flags.VisitAll(func(f *flag.Flag) {
+		if !reloadableFlags[f.Name] && f.Value.String() != r.flags.Lookup(f.Name).Value.String() {
+			slog.Warn("Option changed, but needs a restart to apply", "option", f.Name)
+		}
+	})
+	r.service.Reconfigure(cfg.settings())
+	r.level.Set(level)
+	if rewatch {
+		if r.watcher != nil {
+			r.watcher.Stop()
+		}
+		r.watcher = watcher
+	}
+	r.flags = flags
+	slog.Info("Configuration reloaded")
+	return nil
+}
+
+// stop stops watching the preload directory
+func (r *reloader) stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.watcher != nil {
+		r.watcher.Stop()
+	}
+}
+
+// changed returns whether any of the flags called names have different values in before and after
+func changed(before *flag.FlagSet, after *flag.FlagSet, names ...string) bool {
+	for _, name := range names {
+		if before.Lookup(name).Value.String() != after.Lookup(name).Value.String() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"github.com/sblundy/inmemorytftp/server"
+	"github.com/sblundy/inmemorytftp/server/store"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloader_Applies(t *testing.T) {
+	configPath := writeTestConfig(t, "[server]\nmax_sessions = 5\n")
+	sut := newTestReloader(t, configPath)
+	writeTestConfig(t, "[server]\nmax_sessions = 10\n[logging]\nlevel = \"debug\"\n", configPath)
+
+	if err := sut.Reload(); err != nil {
+		t.Fatal("Reload failed", err)
+	}
+
+	if sessions := sut.service.Settings().MaxSessions; sessions != 10 {
+		t.Error("Max sessions not applied", sessions)
+	}
+	if sut.level.Level() != slog.LevelDebug {
+		t.Error("Log level not applied", sut.level.Level())
+	}
+}
+
+func TestReloader_FailureChangesNothing(t *testing.T) {
+	configPath := writeTestConfig(t, "[server]\nmax_sessions = 5\n")
+	sut := newTestReloader(t, configPath)
+	missing := filepath.Join(t.TempDir(), "missing")
+	writeTestConfig(t, "[server]\nmax_sessions = 10\n[logging]\nlevel = \"debug\"\n[preload]\ndir = \""+missing+"\"\nwatch = true\n", configPath)
+
+	if err := sut.Reload(); err == nil {
+		t.Fatal("Expected reload to fail")
+	}
+
+	if sessions := sut.service.Settings().MaxSessions; sessions != 5 {
+		t.Error("Max sessions changed by a failed reload", sessions)
+	}
+	if sut.level.Level() != slog.LevelInfo {
+		t.Error("Log level changed by a failed reload", sut.level.Level())
+	}
+	if sut.watcher != nil || sut.flags.Lookup("preload").Value.String() != "" {
+		t.Error("Preload changed by a failed reload")
+	}
+}
+
+// newTestReloader starts from the configuration in configPath, as main does
+func newTestReloader(t *testing.T, configPath string) *reloader {
+	t.Helper()
+	args := []string{"-config", configPath}
+	flags := flag.NewFlagSet("inmemorytftp", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	cfg := defineOptions(flags)
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.resolve(flags); err != nil {
+		t.Fatal(err)
+	}
+	service := server.New(0, time.Second)
+	service.Reconfigure(cfg.settings())
+	return &reloader{args: args, flags: flags, service: &service, files: store.New(), level: new(slog.LevelVar)}
+}
+
+// writeTestConfig writes contents to a new config file, or over path if given, returning its path
+func writeTestConfig(t *testing.T, contents string, path ...string) string {
+	t.Helper()
+	target := filepath.Join(t.TempDir(), "config.toml")
+	if len(path) > 0 {
+		target = path[0]
+	}
+	if err := os.WriteFile(target, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
@@ -0,0 +1,109 @@
+// Package acl decides which clients may read and write which files.
+//
+// An ACL is a list of rules, each allowing or denying requests from a set of client networks, in one or both
+// directions, for filenames starting with a prefix. The first rule matching a request decides it, and requests no rule
+// matches get the ACL's default.
+package acl
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	Read  = "read"
+	Write = "write"
+	// Any matches both directions
+	Any = ""
+)
+
+// Rule allows or denies the requests it matches
+type Rule struct {
+	Allow bool
+	// Clients are the networks the rule applies to. Empty matches every client
+	Clients []*net.IPNet
+	// Direction is Read, Write or Any
+	Direction string
+	// Prefix is the start of the filenames the rule applies to. Empty matches every file
+	Prefix string
+}
+
+// NewRule parses a rule, where action is "allow" or "deny" and each client is an IP address or a CIDR network
+func NewRule(action string, clients []string, direction string, prefix string) (Rule, error) {
+	rule := Rule{Direction: direction, Prefix: prefix}
+	switch action {
+	case "allow":
+		rule.Allow = true
+	case "deny":
+	default:
+		return Rule{}, fmt.Errorf("action must be allow or deny, not %q", action)
+	}
+	switch direction {
+	case Read, Write, Any:
+	default:
+		return Rule{}, fmt.Errorf("direction must be read or write, not %q", direction)
+	}
+	for _, client := range clients {
+		network, err := parseNetwork(client)
+		if err != nil {
+			return Rule{}, err
+		}
+		rule.Clients = append(rule.Clients, network)
+	}
+	return rule, nil
+}
+
+func parseNetwork(client string) (*net.IPNet, error) {
+	if strings.Contains(client, "/") {
+		_, network, err := net.ParseCIDR(client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", client)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", client)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func (rule Rule) matches(client net.IP, direction string, filename string) bool {
+	if rule.Direction != Any && rule.Direction != direction {
+		return false
+	}
+	if !strings.HasPrefix(filename, rule.Prefix) {
+		return false
+	}
+	if len(rule.Clients) == 0 {
+		return true
+	}
+	for _, network := range rule.Clients {
+		if network.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL is a list of rules, the first match deciding each request
+type ACL struct {
+	Rules []Rule
+	// DefaultAllow decides requests that no rule matches
+	DefaultAllow bool
+}
+
+// Allowed returns whether client may make a request in direction for filename
+func (acl *ACL) Allowed(client net.IP, direction string, filename string) bool {
+	for _, rule := range acl.Rules {
+		if rule.matches(client, direction, filename) {
+			return rule.Allow
+		}
+	}
+	return acl.DefaultAllow
+}
@@ -0,0 +1,67 @@
+package acl
+
+import (
+	"net"
+	"testing"
+)
+
+func mustRule(t *testing.T, action string, clients []string, direction string, prefix string) Rule {
+	t.Helper()
+	rule, err := NewRule(action, clients, direction, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rule
+}
+
+func TestACL_Allowed(t *testing.T) {
+	sut := &ACL{Rules: []Rule{
+		mustRule(t, "allow", []string{"10.1.0.0/16", "192.0.2.7"}, Write, "configs/"),
+		mustRule(t, "deny", nil, Write, ""),
+		mustRule(t, "deny", []string{"2001:db8::/32"}, Any, "secret/"),
+	}, DefaultAllow: true}
+
+	for _, tc := range []struct {
+		client    string
+		direction string
+		filename  string
+		expected  bool
+	}{
+		{"10.1.2.3", Write, "configs/sw1.cfg", true},
+		{"192.0.2.7", Write, "configs/sw1.cfg", true},
+		{"192.0.2.8", Write, "configs/sw1.cfg", false},
+		{"10.1.2.3", Write, "pxe/boot.img", false},
+		{"10.1.2.3", Read, "pxe/boot.img", true},
+		{"2001:db8::1", Read, "secret/key", false},
+		{"2001:db9::1", Read, "secret/key", true},
+	} {
+		if actual := sut.Allowed(net.ParseIP(tc.client), tc.direction, tc.filename); actual != tc.expected {
+			t.Errorf("Expected %s %s %s allowed to be %t", tc.client, tc.direction, tc.filename, tc.expected)
+		}
+	}
+}
+
+func TestACL_DefaultDeny(t *testing.T) {
+	sut := &ACL{Rules: []Rule{mustRule(t, "allow", []string{"127.0.0.1"}, Any, "")}}
+
+	if !sut.Allowed(net.ParseIP("127.0.0.1"), Read, "a") || sut.Allowed(net.ParseIP("127.0.0.2"), Read, "a") {
+		t.Error("Expected only 127.0.0.1 to be allowed")
+	}
+}
+
+func TestNewRule_Invalid(t *testing.T) {
+	for _, tc := range []struct {
+		action    string
+		clients   []string
+		direction string
+	}{
+		{"permit", nil, Any},
+		{"allow", []string{"10.0.0.0/33"}, Any},
+		{"allow", []string{"host"}, Any},
+		{"allow", nil, "both"},
+	} {
+		if _, err := NewRule(tc.action, tc.clients, tc.direction, ""); err == nil {
+			t.Errorf("Expected %+v to be invalid", tc)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+// Package admin serves an HTTP API for managing the files in a store, alongside the TFTP server.
+//
+//	GET    /api/files?prefix=&after=&limit=  list files, as {"files": [...], "next": "..."}
+//	GET    /api/files/{name}                 download a file. ?version=N for an older version
+//	PUT    /api/files/{name}                 upload a file, returning its metadata
+//	DELETE /api/files/{name}                 delete a file and all its versions
+//	GET    /api/stat/{name}                  the metadata of a file
+//	GET    /api/versions/{name}              the metadata of every version of a file
+//	POST   /api/rename/{name}                rename a file, given {"to": "new name"}
+//	POST   /api/rollback/{name}              make an older version the latest again, given {"version": N}
+//	GET    /api/stats                        a summary of the store
+//	GET    /api/transfers                    the TFTP transfers in progress. See WithTransfers
+//	DELETE /api/transfers/{session}          cancel a transfer
+//	POST   /api/reload                       reload the server's configuration. See WithReloader
+//
+// A {name} is the rest of the path, with any characters that need it escaped. Escape slashes as %2F where the name
+// has a leading slash or would otherwise be cleaned, such as "/pxelinux.0".
+//
+// Errors are returned as {"error": "..."}.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sblundy/inmemorytftp/server"
+	"github.com/sblundy/inmemorytftp/server/store"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxListLimit caps the page size of a listing, so a single request can't make the server build a huge response
+const maxListLimit = 1000
+
+type Server struct {
+	files     store.Store
+	transfers Transfers
+	reloader  Reloader
+	token     string
+	mux       *http.ServeMux
+	// open holds the endpoints served without authorisation. See HandleUnauthenticated
+	open *http.ServeMux
+}
+
+// Transfers lists and cancels the transfers in progress. It's implemented by server.TftpServer
+type Transfers interface {
+	Transfers() []server.TransferInfo
+	CancelTransfer(session uint64) error
+}
+
+// Reloader reloads the server's configuration, returning why it couldn't if the new configuration is invalid
+type Reloader interface {
+	Reload() error
+}
+
+// Option customises a Server created by New
+type Option func(*Server)
+
+// WithTransfers serves the transfers in progress, so they can be inspected and cancelled. Without it, /api/transfers
+// is not found.
+func WithTransfers(transfers Transfers) Option {
+	return func(s *Server) {
+		s.transfers = transfers
+	}
+}
+
+// WithReloader serves an endpoint to reload the configuration with reloader. Without it, /api/reload is not found.
+func WithReloader(reloader Reloader) Option {
+	return func(s *Server) {
+		s.reloader = reloader
+	}
+}
+
+// WithToken requires every request to carry the header "Authorization: Bearer <token>".
+func WithToken(token string) Option {
+	return func(s *Server) {
+		s.token = token
+	}
+}
+
+func New(files store.Store, opts ...Option) *Server {
+	s := &Server{files: files, mux: http.NewServeMux(), open: http.NewServeMux()}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.mux.Handle("/api/files", methods{http.MethodGet: s.list})
+	s.mux.Handle("/api/files/", named("/api/files/", methods{
+		http.MethodGet:    s.download,
+		http.MethodPut:    s.upload,
+		http.MethodDelete: s.delete,
+	}))
+	s.mux.Handle("/api/stat/", named("/api/stat/", methods{http.MethodGet: s.stat}))
+	s.mux.Handle("/api/versions/", named("/api/versions/", methods{http.MethodGet: s.versions}))
+	s.mux.Handle("/api/rename/", named("/api/rename/", methods{http.MethodPost: s.rename}))
+	s.mux.Handle("/api/rollback/", named("/api/rollback/", methods{http.MethodPost: s.rollback}))
+	s.mux.Handle("/api/stats", methods{http.MethodGet: s.stats})
+	if s.transfers != nil {
+		s.mux.Handle("/api/transfers", methods{http.MethodGet: s.listTransfers})
+		s.mux.Handle("/api/transfers/", methods{http.MethodDelete: s.cancelTransfer})
+	}
+	if s.reloader != nil {
+		s.mux.Handle("/api/reload", methods{http.MethodPost: s.reload})
+	}
+	return s
+}
+
+// methods routes a request to the handler for its method
+type methods map[string]http.HandlerFunc
+
+func (m methods) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler, ok := m[r.Method]
+	if !ok {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	handler(w, r)
+}
+
+type nameKey struct{}
+
+// named passes the rest of the path after prefix to handler as the filename. See filename. The filename is taken from
+// the escaped path, so a name with a leading slash or dot segments can be sent with its slashes escaped as %2F without
+// being cleaned away.
+func named(prefix string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		escaped, ok := strings.CutPrefix(r.URL.EscapedPath(), prefix)
+		name, err := url.PathUnescape(escaped)
+		if !ok || err != nil || name == "" {
+			writeError(w, http.StatusNotFound, errors.New("no filename given"))
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), nameKey{}, name)))
+	})
+}
+
+func filename(r *http.Request) string {
+	return r.Context().Value(nameKey{}).(string)
+}
+
+// Handle adds another endpoint to the server, behind the same authorisation as the rest of the API.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// HandleUnauthenticated adds an endpoint that doesn't need the token, such as a health check probed by an orchestrator.
+func (s *Server) HandleUnauthenticated(pattern string, handler http.Handler) {
+	s.open.Handle(pattern, handler)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler, pattern := s.open.Handler(r); pattern != "" {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	if s.token != "" && !s.authorised(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("unauthorised"))
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) authorised(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+type listResponse struct {
+	Files []store.FileInfo `json:"files"`
+	Next  string           `json:"next,omitempty"`
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := store.ListOptions{Prefix: query.Get("prefix"), After: query.Get("after"), Limit: maxListLimit}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be a positive number"))
+			return
+		}
+		if n < maxListLimit {
+			opts.Limit = n
+		}
+	}
+	files, next := s.files.List(opts)
+	if files == nil {
+		files = []store.FileInfo{}
+	}
+	writeJSON(w, http.StatusOK, listResponse{Files: files, Next: next})
+}
+
+func (s *Server) download(w http.ResponseWriter, r *http.Request) {
+	name := filename(r)
+	version := 0
+	if v := r.URL.Query().Get("version"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("version must be a positive number"))
+			return
+		}
+		version = n
+	}
+	contents, meta, prs := s.files.OpenVersion(name, version)
+	if !prs {
+		writeError(w, http.StatusNotFound, store.ErrNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+	w.Header().Set("ETag", strconv.Quote(meta.SHA256))
+	w.Header().Set("Last-Modified", meta.Modified.UTC().Format(http.TimeFormat))
+	if _, err := io.Copy(w, contents); err != nil {
+		slog.Error("Unable to send", "filename", name, "error", err)
+	}
+}
+
+func (s *Server) upload(w http.ResponseWriter, r *http.Request) {
+	name := filename(r)
+	// A file bigger than the store's whole memory budget could never be kept, so it's refused before it's all buffered
+	body := r.Body
+	if budget := s.files.MemoryBudget(); budget > 0 {
+		body = http.MaxBytesReader(w, r.Body, budget)
+	}
+	upload := s.files.PutWriter(name, store.Origin{Uploader: r.RemoteAddr, Mode: "http"})
+	if _, err := io.Copy(upload, body); err != nil {
+		upload.Abort()
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) || errors.Is(err, store.ErrTooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, store.ErrTooLarge)
+			return
+		}
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	meta, err := upload.Commit()
+	if err != nil {
+		slog.Error("Unable to store", "filename", name, "error", err)
+		writeError(w, http.StatusInternalServerError, errors.New("unable to store file"))
+		return
+	}
+	writeJSON(w, http.StatusOK, store.FileInfo{Name: name, Metadata: meta})
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request) {
+	prs, err := s.files.Delete(filename(r))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !prs {
+		writeError(w, http.StatusNotFound, store.ErrNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) stat(w http.ResponseWriter, r *http.Request) {
+	name := filename(r)
+	meta, prs := s.files.Stat(name)
+	if !prs {
+		writeError(w, http.StatusNotFound, store.ErrNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, store.FileInfo{Name: name, Metadata: meta})
+}
+
+func (s *Server) versions(w http.ResponseWriter, r *http.Request) {
+	versions := s.files.Versions(filename(r))
+	if versions == nil {
+		writeError(w, http.StatusNotFound, store.ErrNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, versions)
+}
+
+type renameRequest struct {
+	To string `json:"to"`
+}
+
+func (s *Server) rename(w http.ResponseWriter, r *http.Request) {
+	var req renameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.To == "" {
+		writeError(w, http.StatusBadRequest, errors.New(`expected {"to": "new name"}`))
+		return
+	}
+	meta, err := s.files.Rename(filename(r), req.To)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, store.ErrExists):
+		writeError(w, http.StatusConflict, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, store.FileInfo{Name: req.To, Metadata: meta})
+	}
+}
+
+type rollbackRequest struct {
+	Version int `json:"version"`
+}
+
+func (s *Server) rollback(w http.ResponseWriter, r *http.Request) {
+	var req rollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Version <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New(`expected {"version": N}`))
+		return
+	}
+	name := filename(r)
+	meta, err := s.files.Rollback(name, req.Version)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, store.FileInfo{Name: name, Metadata: meta})
+	}
+}
+
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.files.Stats())
+}
+
+func (s *Server) listTransfers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.transfers.Transfers())
+}
+
+func (s *Server) cancelTransfer(w http.ResponseWriter, r *http.Request) {
+	session, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/api/transfers/"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("session must be a number"))
+		return
+	}
+	err = s.transfers.CancelTransfer(session)
+	switch {
+	case errors.Is(err, server.ErrNoSuchTransfer):
+		writeError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) reload(w http.ResponseWriter, r *http.Request) {
+	if err := s.reloader.Reload(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Unable to write response", "error", err)
+	}
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,252 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/sblundy/inmemorytftp/server"
+	"github.com/sblundy/inmemorytftp/server/store"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdmin_UploadAndDownload(t *testing.T) {
+	files := store.New()
+	sut := New(files)
+
+	res := serve(sut, http.MethodPut, "/api/files/pxe/boot.img", "boot image")
+	if res.Code != http.StatusOK {
+		t.Fatal("Upload failed", res.Code, res.Body)
+	}
+	var info store.FileInfo
+	json.Unmarshal(res.Body.Bytes(), &info)
+	if info.Name != "pxe/boot.img" || info.Size != 10 || info.Mode != "http" {
+		t.Error("Metadata incorrect", info)
+	}
+
+	res = serve(sut, http.MethodGet, "/api/files/pxe/boot.img", "")
+	if res.Code != http.StatusOK || res.Body.String() != "boot image" {
+		t.Error("Download failed", res.Code, res.Body)
+	}
+	if contents, _ := files.Get("pxe/boot.img"); string(contents) != "boot image" {
+		t.Error("Not stored", contents)
+	}
+}
+
+func TestAdmin_LeadingSlash(t *testing.T) {
+	files := store.New()
+	files.Put("/pxelinux.0", []byte("pxelinux"))
+	sut := New(files)
+
+	if res := serve(sut, http.MethodGet, "/api/files/%2Fpxelinux.0", ""); res.Code != http.StatusOK || res.Body.String() != "pxelinux" {
+		t.Error("Download failed", res.Code, res.Body)
+	}
+	if res := serve(sut, http.MethodGet, "/api/stat/%2Fpxelinux.0", ""); res.Code != http.StatusOK {
+		t.Error("Stat failed", res.Code, res.Body)
+	}
+	if res := serve(sut, http.MethodPost, "/api/rename/%2Fpxelinux.0", `{"to": "/boot/pxelinux.0"}`); res.Code != http.StatusOK {
+		t.Fatal("Rename failed", res.Code, res.Body)
+	}
+	if res := serve(sut, http.MethodDelete, "/api/files/%2Fboot%2Fpxelinux.0", ""); res.Code != http.StatusNoContent {
+		t.Error("Delete failed", res.Code, res.Body)
+	}
+	if res := serve(sut, http.MethodPut, "/api/files/%2Fa%2F..%2Fb.img", "b"); res.Code != http.StatusOK {
+		t.Error("Upload failed", res.Code, res.Body)
+	}
+	if _, prs := files.Stat("/a/../b.img"); !prs {
+		t.Error("Expected the name to be stored as sent")
+	}
+}
+
+func TestAdmin_UploadOverMemoryBudget(t *testing.T) {
+	files := store.New(store.WithMemoryBudget(8))
+	sut := New(files)
+
+	res := serve(sut, http.MethodPut, "/api/files/big.img", "more than eight bytes")
+
+	if res.Code != http.StatusRequestEntityTooLarge {
+		t.Error("Expected upload to be refused", res.Code, res.Body)
+	}
+	if _, prs := files.Stat("big.img"); prs {
+		t.Error("Expected nothing stored")
+	}
+	if res := serve(sut, http.MethodPut, "/api/files/small.img", "small"); res.Code != http.StatusOK {
+		t.Error("Expected upload within the budget to succeed", res.Code, res.Body)
+	}
+}
+
+func TestAdmin_DownloadMissing(t *testing.T) {
+	sut := New(store.New())
+
+	res := serve(sut, http.MethodGet, "/api/files/missing.img", "")
+
+	if res.Code != http.StatusNotFound || !strings.Contains(res.Body.String(), `"error"`) {
+		t.Error("Expected not found", res.Code, res.Body)
+	}
+}
+
+func TestAdmin_List(t *testing.T) {
+	files := store.New()
+	for _, name := range []string{"pxe/a.img", "pxe/b.img", "cfg/a.cfg"} {
+		files.Put(name, []byte(name))
+	}
+	sut := New(files)
+
+	res := serve(sut, http.MethodGet, "/api/files?prefix=pxe/&limit=1", "")
+
+	var list listResponse
+	json.Unmarshal(res.Body.Bytes(), &list)
+	if res.Code != http.StatusOK || len(list.Files) != 1 || list.Files[0].Name != "pxe/a.img" || list.Next != "pxe/a.img" {
+		t.Error("List incorrect", res.Code, res.Body)
+	}
+}
+
+func TestAdmin_RenameAndDelete(t *testing.T) {
+	files := store.New()
+	files.Put("old.cfg", []byte("config"))
+	sut := New(files)
+
+	if res := serve(sut, http.MethodPost, "/api/rename/old.cfg", `{"to": "new.cfg"}`); res.Code != http.StatusOK {
+		t.Fatal("Rename failed", res.Code, res.Body)
+	}
+	if res := serve(sut, http.MethodGet, "/api/stat/new.cfg", ""); res.Code != http.StatusOK {
+		t.Error("Renamed file missing", res.Code, res.Body)
+	}
+	if res := serve(sut, http.MethodDelete, "/api/files/new.cfg", ""); res.Code != http.StatusNoContent {
+		t.Error("Delete failed", res.Code, res.Body)
+	}
+	if res := serve(sut, http.MethodDelete, "/api/files/new.cfg", ""); res.Code != http.StatusNotFound {
+		t.Error("Expected second delete to find nothing", res.Code)
+	}
+}
+
+func TestAdmin_Rollback(t *testing.T) {
+	files := store.New(store.WithHistory(5, 0))
+	files.Put("boot.cfg", []byte("first"))
+	files.Put("boot.cfg", []byte("second"))
+	sut := New(files)
+
+	res := serve(sut, http.MethodPost, "/api/rollback/boot.cfg", `{"version": 1}`)
+	var info store.FileInfo
+	json.Unmarshal(res.Body.Bytes(), &info)
+	if res.Code != http.StatusOK || info.Version != 3 {
+		t.Fatal("Rollback failed", res.Code, res.Body)
+	}
+	if contents, _ := files.Get("boot.cfg"); string(contents) != "first" {
+		t.Error("Expected first version restored", string(contents))
+	}
+	if res := serve(sut, http.MethodPost, "/api/rollback/boot.cfg", `{"version": 9}`); res.Code != http.StatusNotFound {
+		t.Error("Expected missing version not found", res.Code)
+	}
+	if res := serve(sut, http.MethodPost, "/api/rollback/boot.cfg", `{}`); res.Code != http.StatusBadRequest {
+		t.Error("Expected bad request without a version", res.Code)
+	}
+}
+
+func TestAdmin_Token(t *testing.T) {
+	sut := New(store.New(), WithToken("secret"))
+
+	if res := serve(sut, http.MethodGet, "/api/stats", ""); res.Code != http.StatusUnauthorized {
+		t.Error("Expected unauthorised without token", res.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	res := httptest.NewRecorder()
+	sut.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Error("Expected token to be accepted", res.Code)
+	}
+}
+
+func TestAdmin_HandleUnauthenticated(t *testing.T) {
+	sut := New(store.New(), WithToken("secret"))
+	sut.HandleUnauthenticated("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	if res := serve(sut, http.MethodGet, "/healthz", ""); res.Code != http.StatusOK {
+		t.Error("Expected health check without token", res.Code)
+	}
+	if res := serve(sut, http.MethodGet, "/api/stats", ""); res.Code != http.StatusUnauthorized {
+		t.Error("Expected the rest of the API to still need the token", res.Code)
+	}
+}
+
+type fakeTransfers []server.TransferInfo
+
+func (f *fakeTransfers) Transfers() []server.TransferInfo {
+	return *f
+}
+
+func (f *fakeTransfers) CancelTransfer(session uint64) error {
+	for i, t := range *f {
+		if t.Session == session {
+			*f = append((*f)[:i], (*f)[i+1:]...)
+			return nil
+		}
+	}
+	return server.ErrNoSuchTransfer
+}
+
+func TestAdmin_Transfers(t *testing.T) {
+	transfers := &fakeTransfers{{Session: 7, Client: "127.0.0.1:1234", Direction: "read", Filename: "boot.img", Block: 3}}
+	sut := New(store.New(), WithTransfers(transfers))
+
+	res := serve(sut, http.MethodGet, "/api/transfers", "")
+	var listed []server.TransferInfo
+	json.Unmarshal(res.Body.Bytes(), &listed)
+	if res.Code != http.StatusOK || len(listed) != 1 || listed[0].Session != 7 || listed[0].Block != 3 {
+		t.Fatal("List incorrect", res.Code, res.Body)
+	}
+	if res := serve(sut, http.MethodDelete, "/api/transfers/7", ""); res.Code != http.StatusNoContent {
+		t.Error("Cancel failed", res.Code, res.Body)
+	}
+	if res := serve(sut, http.MethodDelete, "/api/transfers/7", ""); res.Code != http.StatusNotFound {
+		t.Error("Expected second cancel to find nothing", res.Code)
+	}
+	if res := serve(sut, http.MethodDelete, "/api/transfers/x", ""); res.Code != http.StatusBadRequest {
+		t.Error("Expected bad request", res.Code)
+	}
+}
+
+type fakeReloader struct {
+	err   error
+	count int
+}
+
+func (f *fakeReloader) Reload() error {
+	f.count++
+	return f.err
+}
+
+func TestAdmin_Reload(t *testing.T) {
+	reloader := &fakeReloader{}
+	sut := New(store.New(), WithReloader(reloader))
+
+	if res := serve(sut, http.MethodPost, "/api/reload", ""); res.Code != http.StatusNoContent || reloader.count != 1 {
+		t.Error("Reload failed", res.Code, res.Body)
+	}
+	reloader.err = errors.New("config.toml:3: server.max_sessions: parse error")
+	res := serve(sut, http.MethodPost, "/api/reload", "")
+	if res.Code != http.StatusUnprocessableEntity || !strings.Contains(res.Body.String(), "config.toml:3") {
+		t.Error("Expected the reload error", res.Code, res.Body)
+	}
+	if res := serve(sut, http.MethodGet, "/api/reload", ""); res.Code != http.StatusMethodNotAllowed {
+		t.Error("Expected method not allowed", res.Code)
+	}
+	if res := serve(New(store.New()), http.MethodPost, "/api/reload", ""); res.Code != http.StatusNotFound {
+		t.Error("Expected reload not found without a reloader", res.Code)
+	}
+}
+
+func serve(sut http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	res := httptest.NewRecorder()
+	sut.ServeHTTP(res, httptest.NewRequest(method, target, r))
+	return res
+}
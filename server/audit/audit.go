@@ -0,0 +1,124 @@
+// Package audit writes one JSON record per transfer to a log file, rotating it once it reaches a size limit.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	OutcomeCompleted = "completed"
+	OutcomeFailed    = "failed"
+)
+
+// Record describes a single transfer, whether it completed or not
+type Record struct {
+	Time      time.Time `json:"time"`
+	Session   uint64    `json:"session,omitempty"`
+	Client    string    `json:"client"`
+	Direction string    `json:"direction"`
+	Filename  string    `json:"filename"`
+	Mode      string    `json:"mode"`
+	// Options holds the options negotiated with the client. Empty, as option negotiation isn't supported yet
+	Options     map[string]string `json:"options,omitempty"`
+	Bytes       int64             `json:"bytes"`
+	Duration    float64           `json:"durationSeconds"`
+	Retransmits int               `json:"retransmits"`
+	Outcome     string            `json:"outcome"`
+	// ErrorCode is the code of the ERROR packet that ended a failed transfer, whichever side sent it
+	ErrorCode *uint16 `json:"errorCode,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Log writes records as JSON lines
+type Log struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	out        io.Writer
+	file       *os.File
+	size       int64
+}
+
+// Open opens the audit log at path, appending to it if it exists. Once it grows past maxSize bytes it's renamed to
+// path.1, shifting older logs up to path.maxBackups, and a new log is started. A maxSize of 0 never rotates. A path of
+// "-" writes to stdout.
+func Open(path string, maxSize int64, maxBackups int) (*Log, error) {
+	l := &Log{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if path == "-" {
+		l.out = os.Stdout
+		return l, nil
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.out = f
+	l.size = info.Size()
+	return nil
+}
+
+// Write appends record to the log.
+func (l *Log) Write(record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file != nil && l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("unable to rotate audit log: %w", err)
+		}
+	}
+	n, err := l.out.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// rotate shifts each backup up by one, dropping the oldest, and starts a new log
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if l.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxBackups))
+		for i := l.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
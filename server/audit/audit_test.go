@@ -0,0 +1,106 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLog_Write(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sut, err := Open(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := uint16(1)
+	records := []Record{
+		{Time: time.Now(), Session: 1, Client: "127.0.0.1:1234", Direction: "read", Filename: "a.txt", Mode: "octet",
+			Bytes: 600, Duration: 0.5, Retransmits: 2, Outcome: OutcomeCompleted},
+		{Time: time.Now(), Client: "127.0.0.1:1234", Direction: "read", Filename: "b.txt", Mode: "octet",
+			Outcome: OutcomeFailed, ErrorCode: &code, Error: "File not found"},
+	}
+	for _, r := range records {
+		if err := sut.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sut.Close()
+
+	lines := readLines(t, path)
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(lines))
+	}
+	if lines[0]["filename"] != "a.txt" || lines[0]["bytes"] != 600.0 || lines[0]["retransmits"] != 2.0 ||
+		lines[0]["outcome"] != OutcomeCompleted {
+		t.Errorf("unexpected record: %v", lines[0])
+	}
+	if _, prs := lines[0]["errorCode"]; prs {
+		t.Errorf("completed record has an error code: %v", lines[0])
+	}
+	if lines[1]["errorCode"] != 1.0 || lines[1]["error"] != "File not found" || lines[1]["outcome"] != OutcomeFailed {
+		t.Errorf("unexpected record: %v", lines[1])
+	}
+}
+
+func TestLog_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	record := Record{Client: "127.0.0.1:1234", Direction: "write", Filename: "a.txt", Mode: "octet", Outcome: OutcomeCompleted}
+	line, _ := json.Marshal(record)
+	// Room for two records per file
+	sut, err := Open(path, int64(2*(len(line)+1)), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := sut.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sut.Close()
+
+	for name, expected := range map[string]int{path: 1, path + ".1": 2, path + ".2": 2} {
+		if n := len(readLines(t, name)); n != expected {
+			t.Errorf("expected %d records in %s, got %d", expected, name, n)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups to be kept")
+	}
+}
+
+func TestLog_Appends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		sut, err := Open(path, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sut.Write(Record{Filename: "a.txt", Outcome: OutcomeCompleted})
+		sut.Close()
+	}
+	if n := len(readLines(t, path)); n != 2 {
+		t.Errorf("expected 2 records, got %d", n)
+	}
+}
+
+func readLines(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,529 @@
+// Package config reads configuration files written in a subset of TOML, and applies them to command line flags.
+//
+// The subset covers comments, [tables], [[arrays of tables]], bare keys, and values that are strings (basic or
+// literal, on one line), integers, floats, booleans or arrays of those. Inline tables, dotted keys, multi-line strings
+// and dates aren't supported.
+//
+// Errors give the file and line, and the key where there is one, e.g.
+//
+//	inmemorytftp.toml:12: store.ttl: invalid value "4x" for flag -ttl: parse error
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Value is a value read from the file, with the line it was on. It's a string, int64, float64, bool or []interface{}
+// of those
+type Value struct {
+	Line  int
+	Value interface{}
+}
+
+// Table is a [table] or an entry of an [[array of tables]]
+type Table struct {
+	Name   string
+	Line   int
+	Values map[string]Value
+}
+
+// Keys returns the keys in the table, sorted
+func (t *Table) Keys() []string {
+	keys := make([]string, 0, len(t.Values))
+	for key := range t.Values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// File is a parsed configuration file
+type File struct {
+	Path string
+	// tables holds each [table] by name, with the keys before the first table under ""
+	tables map[string]*Table
+	// arrays holds the entries of each [[array of tables]] by name
+	arrays map[string][]*Table
+}
+
+// Error is a problem with the file, at a line and key
+type Error struct {
+	Path string
+	Line int
+	// Key is the table and key, as table.key. Empty if the problem isn't with a key
+	Key string
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("%s:%d: %v", e.Path, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s:%d: %s: %v", e.Path, e.Line, e.Key, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Errorf returns an Error at line and key
+func (f *File) Errorf(line int, key string, format string, args ...interface{}) error {
+	return &Error{Path: f.Path, Line: line, Key: key, Err: fmt.Errorf(format, args...)}
+}
+
+// Load reads and parses the file at path
+func Load(path string) (*File, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(path, contents)
+}
+
+// Parse parses contents, naming the file path in errors
+func Parse(path string, contents []byte) (*File, error) {
+	f := &File{Path: path, tables: map[string]*Table{"": {Values: map[string]Value{}}}, arrays: map[string][]*Table{}}
+	if !utf8.Valid(contents) {
+		return nil, f.Errorf(1, "", "not valid UTF-8")
+	}
+	p := &parser{file: f, input: string(bytes.ReplaceAll(contents, []byte("\r\n"), []byte("\n"))), line: 1}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Table returns the [table] called name, or nil if there isn't one. The keys before the first table are under ""
+func (f *File) Table(name string) *Table {
+	return f.tables[name]
+}
+
+// Array returns the entries of the [[array of tables]] called name
+func (f *File) Array(name string) []*Table {
+	return f.arrays[name]
+}
+
+// ListFlag is a flag that may be repeated. When set from an environment variable, it's given each item of a comma
+// separated list
+type ListFlag interface {
+	flag.Value
+	IsList() bool
+}
+
+// Apply sets the flag that each key maps to, as table.key, unless it's in set, adding the flags it sets to set. An
+// array sets its flag once for each item. Keys that aren't in keys are errors, as are [[arrays of tables]] that aren't
+// in arrays, which the caller reads itself.
+func (f *File) Apply(fs *flag.FlagSet, keys map[string]string, set map[string]bool, arrays ...string) error {
+	for name, entries := range f.arrays {
+		if !contains(arrays, name) {
+			return f.Errorf(entries[0].Line, "", "unknown array of tables [[%s]]", name)
+		}
+	}
+	names := make([]string, 0, len(f.tables))
+	for name := range f.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		table := f.tables[name]
+		for _, key := range table.Keys() {
+			value := table.Values[key]
+			fullKey := key
+			if name != "" {
+				fullKey = name + "." + key
+			}
+			flagName, known := keys[fullKey]
+			if !known {
+				return f.Errorf(value.Line, fullKey, "unknown key")
+			}
+			if set[flagName] {
+				continue
+			}
+			if err := setFlag(fs, flagName, value.Value); err != nil {
+				return f.Errorf(value.Line, fullKey, "%v", err)
+			}
+			set[flagName] = true
+		}
+	}
+	return nil
+}
+
+func setFlag(fs *flag.FlagSet, name string, value interface{}) error {
+	items, isList := value.([]interface{})
+	if !isList {
+		items = []interface{}{value}
+	} else if _, listFlag := fs.Lookup(name).Value.(ListFlag); !listFlag {
+		return errors.New("expected a single value, not an array")
+	}
+	for _, item := range items {
+		if _, nested := item.([]interface{}); nested {
+			return errors.New("expected an array of values, not of arrays")
+		}
+		if err := fs.Set(name, fmt.Sprint(item)); err != nil {
+			return fmt.Errorf("invalid value %q for flag -%s: %v", fmt.Sprint(item), name, err)
+		}
+	}
+	return nil
+}
+
+// ApplyEnv sets each flag not in set from the environment variable named after it, with prefix, e.g. the flag
+// -max-sessions from PREFIX_MAX_SESSIONS. It adds the flags it sets to set.
+func ApplyEnv(fs *flag.FlagSet, prefix string, set map[string]bool) error {
+	var err error
+	fs.VisitAll(func(fl *flag.Flag) {
+		if err != nil || set[fl.Name] {
+			return
+		}
+		name := EnvName(prefix, fl.Name)
+		value, prs := os.LookupEnv(name)
+		if !prs {
+			return
+		}
+		items := []string{value}
+		if _, isList := fl.Value.(ListFlag); isList {
+			items = strings.Split(value, ",")
+		}
+		for _, item := range items {
+			if setErr := fs.Set(fl.Name, item); setErr != nil {
+				err = fmt.Errorf("$%s: invalid value %q for flag -%s: %v", name, item, fl.Name, setErr)
+				return
+			}
+		}
+		set[fl.Name] = true
+	})
+	return err
+}
+
+// EnvName returns the environment variable ApplyEnv reads the flag from
+func EnvName(prefix string, flagName string) string {
+	return prefix + "_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parser reads the file a character at a time
+type parser struct {
+	file  *File
+	input string
+	pos   int
+	line  int
+	// table is where key/value pairs are being added
+	table *Table
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return p.file.Errorf(p.line, "", format, args...)
+}
+
+func (p *parser) parse() error {
+	p.table = p.file.tables[""]
+	for {
+		p.skipSpace()
+		if p.eof() {
+			return nil
+		}
+		switch c := p.peek(); {
+		case c == '\n':
+			p.next()
+		case c == '#':
+			p.skipComment()
+		case c == '[':
+			if err := p.parseHeader(); err != nil {
+				return err
+			}
+		default:
+			if err := p.parseKeyValue(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *parser) peek() byte {
+	return p.input[p.pos]
+}
+
+func (p *parser) next() byte {
+	c := p.input[p.pos]
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return c
+}
+
+// skipSpace skips spaces and tabs, but not newlines
+func (p *parser) skipSpace() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+}
+
+func (p *parser) skipComment() {
+	for !p.eof() && p.peek() != '\n' {
+		p.pos++
+	}
+}
+
+// endLine expects nothing but a comment before the end of the line
+func (p *parser) endLine() error {
+	p.skipSpace()
+	if p.eof() {
+		return nil
+	}
+	switch p.peek() {
+	case '#':
+		p.skipComment()
+		return nil
+	case '\n':
+		return nil
+	}
+	return p.errorf("unexpected %q after value", p.peek())
+}
+
+func (p *parser) parseHeader() error {
+	line := p.line
+	p.next()
+	array := !p.eof() && p.peek() == '['
+	if array {
+		p.next()
+	}
+	p.skipSpace()
+	start := p.pos
+	for !p.eof() && (isBareKeyChar(p.peek()) || p.peek() == '.') {
+		p.pos++
+	}
+	name := p.input[start:p.pos]
+	p.skipSpace()
+	closing := "]"
+	if array {
+		closing = "]]"
+	}
+	if name == "" || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") || strings.Contains(name, "..") {
+		return p.errorf("invalid table name")
+	}
+	if !strings.HasPrefix(p.input[p.pos:], closing) {
+		return p.errorf("expected %s to close table [%s", closing, name)
+	}
+	p.pos += len(closing)
+	table := &Table{Name: name, Line: line, Values: map[string]Value{}}
+	if array {
+		if _, prs := p.file.tables[name]; prs {
+			return p.errorf("[[%s]] is already a table", name)
+		}
+		p.file.arrays[name] = append(p.file.arrays[name], table)
+	} else {
+		if _, prs := p.file.tables[name]; prs {
+			return p.errorf("table [%s] defined twice", name)
+		}
+		if _, prs := p.file.arrays[name]; prs {
+			return p.errorf("[%s] is already an array of tables", name)
+		}
+		p.file.tables[name] = table
+	}
+	p.table = table
+	return p.endLine()
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *parser) parseKeyValue() error {
+	line := p.line
+	start := p.pos
+	for !p.eof() && isBareKeyChar(p.peek()) {
+		p.pos++
+	}
+	key := p.input[start:p.pos]
+	if key == "" {
+		return p.errorf("expected a key, found %q", p.peek())
+	}
+	fullKey := key
+	if p.table.Name != "" {
+		fullKey = p.table.Name + "." + key
+	}
+	p.skipSpace()
+	if p.eof() || p.peek() != '=' {
+		return p.file.Errorf(line, fullKey, "expected = after key")
+	}
+	p.next()
+	p.skipSpace()
+	value, err := p.parseValue()
+	if err != nil {
+		return p.file.Errorf(line, fullKey, "%v", err)
+	}
+	if _, prs := p.table.Values[key]; prs {
+		return p.file.Errorf(line, fullKey, "defined twice")
+	}
+	p.table.Values[key] = Value{Line: line, Value: value}
+	return p.endLine()
+}
+
+func (p *parser) parseValue() (interface{}, error) {
+	if p.eof() || p.peek() == '\n' {
+		return nil, errors.New("missing value")
+	}
+	switch c := p.peek(); {
+	case c == '"':
+		return p.parseBasicString()
+	case c == '\'':
+		return p.parseLiteralString()
+	case c == '[':
+		return p.parseArray()
+	case c == '{':
+		return nil, errors.New("inline tables aren't supported")
+	}
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune(" \t\n#,]", rune(p.peek())) {
+		p.pos++
+	}
+	return parseScalar(p.input[start:p.pos])
+}
+
+func parseScalar(s string) (interface{}, error) {
+	switch s {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if i, err := strconv.ParseInt(strings.ReplaceAll(s, "_", ""), 10, 64); err == nil && !strings.HasPrefix(s, "_") {
+		return i, nil
+	}
+	if strings.ContainsAny(s, ".eE") {
+		if f, err := strconv.ParseFloat(strings.ReplaceAll(s, "_", ""), 64); err == nil {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid value %q. Strings must be quoted", s)
+}
+
+func (p *parser) parseBasicString() (string, error) {
+	p.next()
+	if strings.HasPrefix(p.input[p.pos:], `""`) {
+		return "", errors.New("multi-line strings aren't supported")
+	}
+	var b strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", errors.New("unterminated string")
+		}
+		c := p.next()
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.eof() {
+				return "", errors.New("unterminated string")
+			}
+			escape := p.next()
+			switch escape {
+			case '"', '\\':
+				b.WriteByte(escape)
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'u', 'U':
+				size := 4
+				if escape == 'U' {
+					size = 8
+				}
+				if p.pos+size > len(p.input) {
+					return "", errors.New("invalid unicode escape")
+				}
+				code, err := strconv.ParseUint(p.input[p.pos:p.pos+size], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(code)) {
+					return "", errors.New("invalid unicode escape")
+				}
+				p.pos += size
+				b.WriteRune(rune(code))
+			default:
+				return "", fmt.Errorf("invalid escape \\%c", escape)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+func (p *parser) parseLiteralString() (string, error) {
+	p.next()
+	if strings.HasPrefix(p.input[p.pos:], `''`) {
+		return "", errors.New("multi-line strings aren't supported")
+	}
+	end := strings.IndexAny(p.input[p.pos:], "'\n")
+	if end < 0 || p.input[p.pos+end] == '\n' {
+		return "", errors.New("unterminated string")
+	}
+	s := p.input[p.pos : p.pos+end]
+	p.pos += end + 1
+	return s, nil
+}
+
+// parseArray reads an array, which may span several lines and have a trailing comma
+func (p *parser) parseArray() ([]interface{}, error) {
+	p.next()
+	items := []interface{}{}
+	for {
+		p.skipSpaceAndComments()
+		if p.eof() {
+			return nil, errors.New("unterminated array")
+		}
+		if p.peek() == ']' {
+			p.next()
+			return items, nil
+		}
+		item, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		p.skipSpaceAndComments()
+		if p.eof() {
+			return nil, errors.New("unterminated array")
+		}
+		switch p.next() {
+		case ',':
+		case ']':
+			return items, nil
+		default:
+			return nil, errors.New("expected , or ] in array")
+		}
+	}
+}
+
+func (p *parser) skipSpaceAndComments() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\n':
+			p.next()
+		case '#':
+			p.skipComment()
+		default:
+			return
+		}
+	}
+}
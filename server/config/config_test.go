@@ -0,0 +1,203 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+const example = `# comment
+top = "level"
+
+[server]
+port = 6_969 # trailing comment
+run_check_interval = '10s'
+listen = [
+  ":69",
+  "[::1]:69", # comment in an array
+]
+
+[store]
+compress = true
+ratio = 0.5
+name = "tab\tand \"quotes\" é"
+
+[[acl.rule]]
+action = "allow"
+
+[[acl.rule]]
+action = "deny"
+`
+
+func TestParse(t *testing.T) {
+	f, err := Parse("test.toml", []byte(example))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := f.Table("").Values["top"]; v.Value != "level" || v.Line != 2 {
+		t.Errorf("top = %#v", v)
+	}
+	server := f.Table("server")
+	if v := server.Values["port"].Value; v != int64(6969) {
+		t.Errorf("port = %#v", v)
+	}
+	if v := server.Values["run_check_interval"].Value; v != "10s" {
+		t.Errorf("run_check_interval = %#v", v)
+	}
+	listen, _ := server.Values["listen"].Value.([]interface{})
+	if len(listen) != 2 || listen[0] != ":69" || listen[1] != "[::1]:69" {
+		t.Errorf("listen = %#v", listen)
+	}
+	store := f.Table("store")
+	if v := store.Values["compress"].Value; v != true {
+		t.Errorf("compress = %#v", v)
+	}
+	if v := store.Values["ratio"].Value; v != 0.5 {
+		t.Errorf("ratio = %#v", v)
+	}
+	if v := store.Values["name"].Value; v != "tab\tand \"quotes\" é" {
+		t.Errorf("name = %#v", v)
+	}
+	rules := f.Array("acl.rule")
+	if len(rules) != 2 || rules[0].Values["action"].Value != "allow" || rules[1].Values["action"].Value != "deny" {
+		t.Errorf("rules = %#v", rules)
+	}
+	if rules[1].Line != 20 {
+		t.Errorf("second rule on line %d, expected 20", rules[1].Line)
+	}
+	if f.Table("missing") != nil {
+		t.Error("missing table returned")
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"key = unquoted", `test.toml:1: key: invalid value "unquoted". Strings must be quoted`},
+		{"\n[a]\nkey = 1\nkey = 2", "test.toml:4: a.key: defined twice"},
+		{"[a]\n[a]", "test.toml:2: table [a] defined twice"},
+		{"[a", "test.toml:1: expected ] to close table [a"},
+		{"key = \"open", "test.toml:1: key: unterminated string"},
+		{"key = [1, 2", "test.toml:1: key: unterminated array"},
+		{"key = 1 2", `test.toml:1: unexpected '2' after value`},
+		{"key", "test.toml:1: key: expected = after key"},
+		{"key =", "test.toml:1: key: missing value"},
+		{"key = {a = 1}", "test.toml:1: key: inline tables aren't supported"},
+		{`key = """a"""`, "test.toml:1: key: multi-line strings aren't supported"},
+		{`key = "\q"`, `test.toml:1: key: invalid escape \q`},
+		{"= 1", `test.toml:1: expected a key, found '='`},
+	}
+	for _, test := range tests {
+		_, err := Parse("test.toml", []byte(test.input))
+		if err == nil || err.Error() != test.want {
+			t.Errorf("Parse(%q) = %v, expected %s", test.input, err, test.want)
+		}
+	}
+}
+
+type list []string
+
+func (l *list) String() string     { return strings.Join(*l, ",") }
+func (l *list) Set(s string) error { *l = append(*l, s); return nil }
+func (l *list) IsList() bool       { return true }
+
+func newFlags() (*flag.FlagSet, *uint, *time.Duration, *list) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	port := fs.Uint("port", 69, "")
+	interval := fs.Duration("run-check-interval", time.Second, "")
+	listen := &list{}
+	fs.Var(listen, "listen", "")
+	return fs, port, interval, listen
+}
+
+var keys = map[string]string{
+	"server.port":               "port",
+	"server.run_check_interval": "run-check-interval",
+	"server.listen":             "listen",
+}
+
+func TestApply(t *testing.T) {
+	fs, port, interval, listen := newFlags()
+	if err := fs.Parse([]string{"-port", "70"}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Parse("test.toml", []byte("[server]\nport = 71\nrun_check_interval = \"5s\"\nlisten = [\":1\", \":2\"]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := map[string]bool{"port": true}
+	if err := f.Apply(fs, keys, set); err != nil {
+		t.Fatal(err)
+	}
+	if *port != 70 {
+		t.Errorf("port = %d, the flag should take precedence", *port)
+	}
+	if *interval != 5*time.Second {
+		t.Errorf("interval = %s", *interval)
+	}
+	if listen.String() != ":1,:2" {
+		t.Errorf("listen = %s", listen)
+	}
+	if !set["listen"] || !set["run-check-interval"] {
+		t.Errorf("set = %v", set)
+	}
+}
+
+func TestApply_Errors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"[server]\nportt = 1", "test.toml:2: server.portt: unknown key"},
+		{"[server]\n\nrun_check_interval = \"4x\"", `test.toml:3: server.run_check_interval: invalid value "4x" for flag -run-check-interval: parse error`},
+		{"[server]\nport = [1, 2]", "test.toml:2: server.port: expected a single value, not an array"},
+		{"[[other]]\n", "test.toml:1: unknown array of tables [[other]]"},
+	}
+	for _, test := range tests {
+		fs, _, _, _ := newFlags()
+		f, err := Parse("test.toml", []byte(test.input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Apply(fs, keys, map[string]bool{})
+		var configErr *Error
+		if err == nil || err.Error() != test.want || !errors.As(err, &configErr) {
+			t.Errorf("Apply(%q) = %v, expected %s", test.input, err, test.want)
+		}
+	}
+	f, _ := Parse("test.toml", []byte("[[acl.rule]]\n"))
+	fs, _, _, _ := newFlags()
+	if err := f.Apply(fs, keys, map[string]bool{}, "acl.rule"); err != nil {
+		t.Errorf("Apply with a known array of tables = %v", err)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	t.Setenv("TEST_PORT", "72")
+	t.Setenv("TEST_RUN_CHECK_INTERVAL", "3s")
+	t.Setenv("TEST_LISTEN", ":1,:2")
+	fs, port, interval, listen := newFlags()
+	set := map[string]bool{"run-check-interval": true}
+	if err := ApplyEnv(fs, "TEST", set); err != nil {
+		t.Fatal(err)
+	}
+	if *port != 72 {
+		t.Errorf("port = %d", *port)
+	}
+	if *interval != time.Second {
+		t.Errorf("interval = %s, the flag should take precedence", *interval)
+	}
+	if listen.String() != ":1,:2" {
+		t.Errorf("listen = %s", listen)
+	}
+
+	t.Setenv("TEST_PORT", "seventy")
+	fs, _, _, _ = newFlags()
+	if err := ApplyEnv(fs, "TEST", map[string]bool{}); err == nil || !strings.HasPrefix(err.Error(), "$TEST_PORT: ") {
+		t.Errorf("ApplyEnv with an invalid value = %v", err)
+	}
+}
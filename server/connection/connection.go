@@ -1,8 +1,9 @@
 package connection
 
 import (
+	"errors"
 	"github.com/sblundy/inmemorytftp/server/packets"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"time"
@@ -21,35 +22,38 @@ type TftpReplyChannel interface {
 }
 
 type Connection struct {
-	logger log.Logger
+	logger *slog.Logger
 	conn   *net.UDPConn
 	raddr  net.Addr
 }
 
 type ResponseChannel struct {
-	logger log.Logger
+	logger *slog.Logger
 	conn   net.PacketConn
 	raddr  net.Addr
 }
 
-func New(destination net.Addr) (TftpPacketConn, error) {
+func New(destination net.Addr, logger *slog.Logger) (TftpPacketConn, error) {
 	laddr, err := net.ResolveUDPAddr("udp", ":")
 	if err != nil {
 		return nil, err
 	}
 
 	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Connection{
-		logger: *log.New(os.Stdout, "Connection ", log.LstdFlags),
+		logger: logger,
 		conn:   conn,
 		raddr:  destination,
 	}, nil
 }
 
-func WrapExisting(conn net.PacketConn, raddr net.Addr) TftpReplyChannel {
+func WrapExisting(conn net.PacketConn, raddr net.Addr, logger *slog.Logger) TftpReplyChannel {
 	return &ResponseChannel{
-		logger: *log.New(os.Stdout, "Connection ", log.LstdFlags),
+		logger: logger,
 		conn:   conn,
 		raddr:  raddr,
 	}
@@ -68,7 +72,13 @@ func (conn *Connection) Read(timeout time.Duration) (packets.Packet, bool) {
 	conn.conn.SetReadDeadline(time.Now().Add(timeout))
 	n, err := conn.conn.Read(buff)
 	if err != nil {
-		conn.logger.Println("ERROR: reading packet", err)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			conn.logger.Debug("Timed out reading packet", "timeout", timeout)
+		} else if errors.Is(err, net.ErrClosed) {
+			conn.logger.Debug("Connection closed while reading packet")
+		} else {
+			conn.logger.Error("Unable to read packet", "error", err)
+		}
 		return nil, false
 	}
 	return packets.Read(buff[:n])
@@ -77,7 +87,7 @@ func (conn *Connection) Read(timeout time.Duration) (packets.Packet, bool) {
 func (conn *Connection) Write(packet packets.Packet) bool {
 	_, err := conn.conn.WriteTo(packet.Bytes(), conn.raddr)
 	if err != nil {
-		conn.logger.Println("ERROR: writing packet", err)
+		conn.logger.Error("Unable to write packet", "error", err)
 		return false
 	}
 	return true
@@ -90,7 +100,7 @@ func (conn *Connection) Close() {
 func (conn *ResponseChannel) Write(packet packets.Packet) bool {
 	_, err := conn.conn.WriteTo(packet.Bytes(), conn.raddr)
 	if err != nil {
-		conn.logger.Println("ERROR: writing packet", err)
+		conn.logger.Error("Unable to write packet", "error", err)
 		return false
 	}
 	return true
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"time"
+)
+
+// EventType says what happened in an Event
+type EventType string
+
+const (
+	// EventRequestReceived is emitted for every read or write request, before it's accepted or denied
+	EventRequestReceived EventType = "request-received"
+	// EventRequestDenied is emitted when a request is turned down with an ERROR packet before a transfer starts
+	EventRequestDenied   EventType = "request-denied"
+	EventTransferStarted EventType = "transfer-started"
+	// EventTransferProgress is emitted for each new block sent or received
+	EventTransferProgress  EventType = "transfer-progress"
+	EventTransferCompleted EventType = "transfer-completed"
+	EventTransferFailed    EventType = "transfer-failed"
+	// EventFileStored is emitted once an upload has been committed to the store, before EventTransferCompleted
+	EventFileStored EventType = "file-stored"
+)
+
+// Event describes something that happened to a request or transfer. Fields that don't apply to the type of event are
+// left empty.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// Session identifies the transfer. It's 0 for requests that haven't started a transfer
+	Session   uint64 `json:"session,omitempty"`
+	Client    string `json:"client"`
+	Direction string `json:"direction"`
+	Filename  string `json:"filename"`
+	Mode      string `json:"mode"`
+	// Block is the last block sent, for a read, or received, for a write
+	Block    uint16        `json:"block,omitempty"`
+	Bytes    int64         `json:"bytes,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	// ErrorCode and Error are from the ERROR packet that denied the request or ended the transfer, whichever side sent it
+	ErrorCode *uint16 `json:"errorCode,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	// Version and SHA256 identify the version of the file stored, for EventFileStored, or being sent, for every event
+	// of a read from EventTransferStarted on
+	Version int    `json:"version,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+}
+
+// Observer is called with each event. It's called on the goroutine handling the request, so it holds up the transfer
+// until it returns, and may be called from several goroutines at once.
+type Observer func(Event)
+
+// WithObserver calls observer with every event. It may be given more than once, in which case each observer is called
+// in the order given.
+func WithObserver(observer Observer) Option {
+	return func(server *TftpServer) {
+		server.observers = append(server.observers, observer)
+	}
+}
+
+// emit passes event to every observer. An observer that panics is logged rather than taking the server down with it
+func (server *TftpServer) emit(event Event) {
+	if len(server.observers) == 0 {
+		return
+	}
+	event.Time = time.Now()
+	for _, observer := range server.observers {
+		server.notify(observer, event)
+	}
+}
+
+func (server *TftpServer) notify(observer Observer, event Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			server.logger.Error("Observer panicked", "event", event.Type, "panic", r)
+		}
+	}()
+	observer(event)
+}
+
+// event returns an event of type typ describing the transfer
+func (t *transfer) event(typ EventType) Event {
+	t.progress.Lock()
+	defer t.progress.Unlock()
+	return Event{
+		Type:      typ,
+		Session:   t.session,
+		Client:    t.client,
+		Direction: t.direction,
+		Filename:  t.filename,
+		Mode:      t.mode,
+		Block:     t.block,
+		Bytes:     t.bytes,
+		Version:   t.version,
+		SHA256:    t.sha256,
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"github.com/sblundy/inmemorytftp/server/packets"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type eventRecorder struct {
+	lock   sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) observe(event Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *eventRecorder) types() []EventType {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	types := make([]EventType, len(r.events))
+	for i, event := range r.events {
+		types[i] = event.Type
+	}
+	return types
+}
+
+func TestEvents_Read(t *testing.T) {
+	recorder := &eventRecorder{}
+	server := New(0, 0, WithObserver(recorder.observe))
+	dummyConn := NewDummyPacketConn("TestEvents_Read", packets.NewAck(1), packets.NewAck(2))
+	sut := server.newTransfer("client", directionRead, "test.txt", "octet")
+	sut.begin(&dummyConn)
+
+	sut.end(HandleReadRequest(sut, bytes.NewReader([]byte(strings.Repeat("12345678", 64)+"test")), DefaultTimeouts, testLogger))
+
+	assertEventTypes(t, recorder.types(), EventTransferStarted, EventTransferProgress, EventTransferProgress, EventTransferCompleted)
+	last := recorder.events[len(recorder.events)-1]
+	if last.Session != sut.session || last.Filename != "test.txt" || last.Block != 2 || last.Bytes != 516 {
+		t.Errorf("Unexpected completed event: %+v", last)
+	}
+}
+
+func TestEvents_ReadStartedWithVersion(t *testing.T) {
+	recorder := &eventRecorder{}
+	server := New(0, 0, WithObserver(recorder.observe))
+	server.store.Put("test.txt", []byte("first"))
+	server.store.Put("test.txt", []byte("second"))
+	meta, _ := server.store.Stat("test.txt")
+	server.Reconfigure(Settings{Timeouts: Timeouts{Block: 50 * time.Millisecond, Ack: 10 * time.Millisecond, Retries: 1}})
+	// Nothing acknowledges the first block, so the transfer fails once it has started
+	client, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer client.Close()
+	dummyConn := NewDummyPacketConn("TestEvents_ReadStartedWithVersion")
+
+	server.onReadRequest(&dummyConn, packets.ReadPacket{Filename: "test.txt", Mode: "octet"}, client.LocalAddr())
+
+	if len(recorder.events) < 2 || recorder.events[1].Type != EventTransferStarted {
+		t.Fatalf("Expected transfer to start, got %v", recorder.types())
+	}
+	if started := recorder.events[1]; started.Version != 2 || started.SHA256 != meta.SHA256 {
+		t.Errorf("Started event missing the version: %+v", started)
+	}
+}
+
+func TestEvents_FailedWrite(t *testing.T) {
+	recorder := &eventRecorder{}
+	server := New(0, 0, WithObserver(recorder.observe))
+	dummyConn := NewDummyPacketConn("TestEvents_FailedWrite", packets.NewError(3, "Disk full"))
+	sut := server.newTransfer("client", directionWrite, "test.txt", "octet")
+	sut.begin(&dummyConn)
+
+	sut.end(HandleWriteRequest(sut, &bufferWriter{}, DefaultTimeouts, testLogger))
+
+	assertEventTypes(t, recorder.types(), EventTransferStarted, EventTransferFailed)
+	last := recorder.events[1]
+	if last.ErrorCode == nil || *last.ErrorCode != 3 || last.Error != "Disk full" {
+		t.Errorf("Unexpected failed event: %+v", last)
+	}
+}
+
+func TestEvents_Denied(t *testing.T) {
+	recorder := &eventRecorder{}
+	server := New(0, 0, WithObserver(recorder.observe))
+	dummyConn := NewDummyPacketConn("TestEvents_Denied")
+
+	server.onReadRequest(&dummyConn, packets.ReadPacket{Filename: "missing.txt", Mode: "octet"}, &net.UDPAddr{})
+
+	assertEventTypes(t, recorder.types(), EventRequestReceived, EventRequestDenied)
+	if denied := recorder.events[1]; denied.ErrorCode == nil || *denied.ErrorCode != 1 || denied.Filename != "missing.txt" {
+		t.Errorf("Unexpected denied event: %+v", denied)
+	}
+}
+
+func TestEvents_ObserverPanic(t *testing.T) {
+	recorder := &eventRecorder{}
+	server := New(0, 0, WithObserver(func(Event) { panic("test") }), WithObserver(recorder.observe))
+
+	server.emit(Event{Type: EventRequestReceived})
+
+	assertEventTypes(t, recorder.types(), EventRequestReceived)
+}
+
+func assertEventTypes(t *testing.T, actual []EventType, expected ...EventType) {
+	t.Helper()
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected events %v, got %v", expected, actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("Expected events %v, got %v", expected, actual)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Package health serves liveness and readiness checks, for an orchestrator to restart or route around an unhealthy
+// instance.
+//
+// Liveness fails when the process needs restarting, and readiness when it shouldn't be sent requests for now. Every
+// liveness check is also a readiness check. Both respond with 200 when every check passes and 503 otherwise, with the
+// outcome of each check:
+//
+//	{"status": "unavailable", "checks": {"tftp": "ok", "sessions": "all 100 sessions in use"}}
+package health
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// Check returns nil if all is well, or an error saying what isn't
+type Check func() error
+
+type check struct {
+	name      string
+	fn        Check
+	readiness bool
+}
+
+// Checker holds the checks
+type Checker struct {
+	lock   sync.Mutex
+	checks []check
+}
+
+func New() *Checker {
+	return &Checker{}
+}
+
+// AddLiveness adds a check that fails if the process needs restarting. It's part of readiness too.
+func (c *Checker) AddLiveness(name string, fn Check) {
+	c.add(check{name: name, fn: fn})
+}
+
+// AddReadiness adds a check that fails while the process can't take requests, but may recover without a restart.
+func (c *Checker) AddReadiness(name string, fn Check) {
+	c.add(check{name: name, fn: fn, readiness: true})
+}
+
+func (c *Checker) add(ch check) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.checks = append(c.checks, ch)
+}
+
+// Report is the outcome of the checks
+type Report struct {
+	Status string `json:"status"`
+	// Checks holds "ok" or the error of each check, by name
+	Checks map[string]string `json:"checks"`
+}
+
+// Live runs the liveness checks
+func (c *Checker) Live() Report {
+	return c.run(false)
+}
+
+// Ready runs the liveness and readiness checks
+func (c *Checker) Ready() Report {
+	return c.run(true)
+}
+
+func (c *Checker) run(readiness bool) Report {
+	c.lock.Lock()
+	checks := append([]check(nil), c.checks...)
+	c.lock.Unlock()
+	report := Report{Status: StatusOK, Checks: make(map[string]string)}
+	for _, ch := range checks {
+		if ch.readiness && !readiness {
+			continue
+		}
+		if err := ch.fn(); err != nil {
+			report.Status = StatusUnavailable
+			report.Checks[ch.name] = err.Error()
+		} else {
+			report.Checks[ch.name] = StatusOK
+		}
+	}
+	return report
+}
+
+// LivenessHandler serves the liveness checks, e.g. as /healthz
+func (c *Checker) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serve(w, c.Live())
+	})
+}
+
+// ReadinessHandler serves the readiness checks, e.g. as /readyz
+func (c *Checker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serve(w, c.Ready())
+	})
+}
+
+func serve(w http.ResponseWriter, report Report) {
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.Error("Unable to write health report", "error", err)
+	}
+}
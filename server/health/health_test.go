@@ -0,0 +1,47 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChecker(t *testing.T) {
+	sut := New()
+	loaded := false
+	sut.AddLiveness("tftp", func() error { return nil })
+	sut.AddLiveness("store", func() error {
+		if !loaded {
+			return errors.New("loading")
+		}
+		return nil
+	})
+	sut.AddReadiness("sessions", func() error { return errors.New("all 1 sessions in use") })
+
+	assertReport(t, sut.LivenessHandler(), http.StatusServiceUnavailable, map[string]string{"tftp": "ok", "store": "loading"})
+	loaded = true
+	assertReport(t, sut.LivenessHandler(), http.StatusOK, map[string]string{"tftp": "ok", "store": "ok"})
+	assertReport(t, sut.ReadinessHandler(), http.StatusServiceUnavailable,
+		map[string]string{"tftp": "ok", "store": "ok", "sessions": "all 1 sessions in use"})
+}
+
+func assertReport(t *testing.T, handler http.Handler, expectedStatus int, expectedChecks map[string]string) {
+	t.Helper()
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/", nil))
+	if res.Code != expectedStatus {
+		t.Errorf("Expected %d, got %d: %s", expectedStatus, res.Code, res.Body)
+	}
+	var report Report
+	json.Unmarshal(res.Body.Bytes(), &report)
+	if len(report.Checks) != len(expectedChecks) {
+		t.Fatalf("Expected checks %v, got %v", expectedChecks, report.Checks)
+	}
+	for name, expected := range expectedChecks {
+		if report.Checks[name] != expected {
+			t.Errorf("Expected checks %v, got %v", expectedChecks, report.Checks)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Package hook runs external commands after files are uploaded or downloaded over TFTP.
+//
+// The command is given the file's contents on stdin and its metadata in the environment:
+//
+//	INMEMORYTFTP_EVENT     upload or download
+//	INMEMORYTFTP_FILENAME  the filename the client gave
+//	INMEMORYTFTP_VERSION   the version of the file stored or sent
+//	INMEMORYTFTP_SIZE      the size of the file in bytes
+//	INMEMORYTFTP_SHA256    the hex encoded SHA-256 digest of the file
+//	INMEMORYTFTP_CLIENT    the address of the client
+//	INMEMORYTFTP_MODE      the transfer mode
+//	INMEMORYTFTP_SESSION   the id of the transfer, as given in the logs
+//
+// If that version of the file is no longer in the store by the time the command runs, stdin is empty.
+package hook
+
+import (
+	"context"
+	"errors"
+	"github.com/sblundy/inmemorytftp/server"
+	"github.com/sblundy/inmemorytftp/server/store"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EventUpload   = "upload"
+	EventDownload = "download"
+)
+
+// maxOutput is how much of a command's output is logged
+const maxOutput = 4096
+
+// Runner runs the commands. Pass its Observe method to server.WithObserver.
+type Runner struct {
+	files    store.Store
+	upload   []string
+	download []string
+	timeout  time.Duration
+	// slots holds a token for each command running, limiting how many run at once
+	slots chan struct{}
+	// ctx is cancelled to kill the commands still running on shutdown
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+	// lock guards stopped, so no command is started once Shutdown is waiting for them
+	lock    sync.Mutex
+	stopped bool
+}
+
+// Option customises a Runner created by New
+type Option func(*Runner)
+
+// OnUpload runs command after each file is uploaded. The command is split into the program and its arguments on
+// white space. It isn't passed to a shell. A blank command runs nothing.
+func OnUpload(command string) Option {
+	return func(r *Runner) {
+		if fields := strings.Fields(command); len(fields) > 0 {
+			r.upload = fields
+		}
+	}
+}
+
+// OnDownload runs command after each file is downloaded successfully. See OnUpload.
+func OnDownload(command string) Option {
+	return func(r *Runner) {
+		if fields := strings.Fields(command); len(fields) > 0 {
+			r.download = fields
+		}
+	}
+}
+
+// WithTimeout kills a command that runs for longer than timeout. Defaults to 30s.
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *Runner) {
+		r.timeout = timeout
+	}
+}
+
+// WithConcurrency runs at most n commands at once, the rest waiting their turn. Defaults to 4.
+func WithConcurrency(n int) Option {
+	return func(r *Runner) {
+		r.slots = make(chan struct{}, n)
+	}
+}
+
+// New creates a Runner that reads the files passed to the commands from files.
+func New(files store.Store, opts ...Option) *Runner {
+	r := &Runner{files: files, timeout: 30 * time.Second, slots: make(chan struct{}, 4)}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if cap(r.slots) < 1 {
+		r.slots = make(chan struct{}, 1)
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	return r
+}
+
+// Observe starts the upload command when an upload is stored, and the download command when a read completes. It
+// doesn't wait for the command to run.
+func (r *Runner) Observe(event server.Event) {
+	switch {
+	case event.Type == server.EventFileStored && r.upload != nil:
+		r.start(r.upload, EventUpload, event)
+	case event.Type == server.EventTransferCompleted && event.Direction == "read" && r.download != nil:
+		r.start(r.download, EventDownload, event)
+	}
+}
+
+func (r *Runner) start(command []string, name string, event server.Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopped {
+		slog.Warn("Hooks shut down, not running", "hook", name, "filename", event.Filename)
+		return
+	}
+	r.running.Add(1)
+	go func() {
+		defer r.running.Done()
+		select {
+		case r.slots <- struct{}{}:
+		case <-r.ctx.Done():
+			return
+		}
+		defer func() { <-r.slots }()
+		r.run(command, name, event)
+	}()
+}
+
+func (r *Runner) run(command []string, name string, event server.Event) {
+	logger := slog.With("hook", name, "session", event.Session, "filename", event.Filename, "command", command[0])
+	ctx, cancel := context.WithTimeout(r.ctx, r.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.WaitDelay = time.Second
+	cmd.Env = append(os.Environ(),
+		"INMEMORYTFTP_EVENT="+name,
+		"INMEMORYTFTP_FILENAME="+event.Filename,
+		"INMEMORYTFTP_VERSION="+strconv.Itoa(event.Version),
+		"INMEMORYTFTP_SIZE="+strconv.FormatInt(event.Bytes, 10),
+		"INMEMORYTFTP_SHA256="+event.SHA256,
+		"INMEMORYTFTP_CLIENT="+event.Client,
+		"INMEMORYTFTP_MODE="+event.Mode,
+		"INMEMORYTFTP_SESSION="+strconv.FormatUint(event.Session, 10),
+	)
+	if contents, _, prs := r.files.OpenVersion(event.Filename, event.Version); prs {
+		cmd.Stdin = contents
+	}
+	output := &limitedBuffer{limit: maxOutput}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	start := time.Now()
+	err := cmd.Run()
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		logger.Error("Hook timed out", "timeout", r.timeout, "output", output.String())
+	case err != nil:
+		logger.Error("Hook failed", "error", err, "output", output.String())
+	default:
+		logger.Info("Hook ran", "duration", time.Since(start), "output", output.String())
+	}
+}
+
+// Shutdown stops accepting new commands and waits for those queued or running to finish. If ctx is done first, those
+// running are killed and those queued are dropped.
+func (r *Runner) Shutdown(ctx context.Context) error {
+	r.lock.Lock()
+	r.stopped = true
+	r.lock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		r.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		r.cancel()
+		return nil
+	case <-ctx.Done():
+		r.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// limitedBuffer keeps the first limit bytes written to it, discarding the rest
+type limitedBuffer struct {
+	lock      sync.Mutex
+	limit     int
+	buf       []byte
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	n := len(p)
+	if room := b.limit - len(b.buf); room < len(p) {
+		p = p[:room]
+		b.truncated = true
+	}
+	b.buf = append(b.buf, p...)
+	return n, nil
+}
+
+func (b *limitedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s := strings.TrimSpace(string(b.buf))
+	if b.truncated {
+		s += "..."
+	}
+	return s
+}
@@ -0,0 +1,109 @@
+package hook
+
+import (
+	"context"
+	"github.com/sblundy/inmemorytftp/server"
+	"github.com/sblundy/inmemorytftp/server/store"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// script writes an executable shell script to dir, skipping the test where there's no shell
+func script(t *testing.T, dir string, body string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("hook tests need a shell")
+	}
+	path := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunner_Upload(t *testing.T) {
+	dir := t.TempDir()
+	files := store.New()
+	files.Put("switch.cfg", []byte("hostname sw1"))
+	meta, _ := files.Stat("switch.cfg")
+	command := script(t, dir, `cat > "$0.stdin"; env | grep ^INMEMORYTFTP_ | sort > "$0.env"`)
+	sut := New(files, OnUpload(command))
+
+	sut.Observe(server.Event{Type: server.EventFileStored, Session: 3, Client: "10.0.0.1:1234", Filename: "switch.cfg",
+		Mode: "octet", Bytes: meta.Size, Version: meta.Version, SHA256: meta.SHA256})
+	sut.Shutdown(context.Background())
+
+	stdin, _ := os.ReadFile(command + ".stdin")
+	if string(stdin) != "hostname sw1" {
+		t.Errorf("Unexpected stdin %q", stdin)
+	}
+	env, _ := os.ReadFile(command + ".env")
+	for _, expected := range []string{
+		"INMEMORYTFTP_EVENT=upload", "INMEMORYTFTP_FILENAME=switch.cfg", "INMEMORYTFTP_VERSION=1",
+		"INMEMORYTFTP_SIZE=12", "INMEMORYTFTP_SHA256=" + meta.SHA256, "INMEMORYTFTP_CLIENT=10.0.0.1:1234",
+		"INMEMORYTFTP_MODE=octet", "INMEMORYTFTP_SESSION=3",
+	} {
+		if !strings.Contains(string(env), expected+"\n") {
+			t.Errorf("Expected %s in environment:\n%s", expected, env)
+		}
+	}
+}
+
+func TestRunner_OnlyMatchingEvents(t *testing.T) {
+	dir := t.TempDir()
+	command := script(t, dir, `echo "$INMEMORYTFTP_EVENT" >> "$0.log"`)
+	sut := New(store.New(), OnDownload(command))
+
+	sut.Observe(server.Event{Type: server.EventFileStored, Filename: "a"})
+	sut.Observe(server.Event{Type: server.EventTransferCompleted, Direction: "write", Filename: "a"})
+	sut.Observe(server.Event{Type: server.EventTransferFailed, Direction: "read", Filename: "a"})
+	sut.Observe(server.Event{Type: server.EventTransferCompleted, Direction: "read", Filename: "a"})
+	sut.Shutdown(context.Background())
+
+	log, _ := os.ReadFile(command + ".log")
+	if string(log) != "download\n" {
+		t.Errorf("Expected one download hook, got %q", log)
+	}
+}
+
+func TestRunner_BlankCommand(t *testing.T) {
+	sut := New(store.New(), OnUpload("  "), OnDownload(""))
+
+	sut.Observe(server.Event{Type: server.EventFileStored, Filename: "a"})
+	sut.Observe(server.Event{Type: server.EventTransferCompleted, Direction: "read", Filename: "a"})
+	sut.Shutdown(context.Background())
+}
+
+func TestRunner_Timeout(t *testing.T) {
+	dir := t.TempDir()
+	command := script(t, dir, `exec sleep 10`)
+	sut := New(store.New(), OnUpload(command), WithTimeout(50*time.Millisecond))
+
+	start := time.Now()
+	sut.Observe(server.Event{Type: server.EventFileStored, Filename: "a"})
+	sut.Shutdown(context.Background())
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the hook to be killed, took %s", elapsed)
+	}
+}
+
+func TestRunner_Concurrency(t *testing.T) {
+	dir := t.TempDir()
+	// Each run fails to create the lock directory if another run holds it
+	command := script(t, dir, `mkdir "$0.lock" || echo overlap >> "$0.log"; sleep 0.05; rmdir "$0.lock"`)
+	sut := New(store.New(), OnUpload(command), WithConcurrency(1))
+
+	for i := 0; i < 4; i++ {
+		sut.Observe(server.Event{Type: server.EventFileStored, Filename: "a"})
+	}
+	sut.Shutdown(context.Background())
+
+	if log, err := os.ReadFile(command + ".log"); err == nil {
+		t.Errorf("Expected hooks to run one at a time: %s", log)
+	}
+}
@@ -0,0 +1,335 @@
+// Package metrics keeps counters, gauges and histograms and serves them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry holds every metric to be exposed
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Counter adds a counter, partitioned by the given label names.
+func (r *Registry) Counter(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{family: newFamily(name, help, "counter", labels)}
+	r.register(c)
+	return c
+}
+
+// Gauge adds a gauge, partitioned by the given label names.
+func (r *Registry) Gauge(name string, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{family: newFamily(name, help, "gauge", labels)}
+	r.register(g)
+	return g
+}
+
+// GaugeFunc adds a gauge whose value is read from f whenever the metrics are collected.
+func (r *Registry) GaugeFunc(name string, help string, f func() float64) {
+	r.register(&gaugeFunc{family: newFamily(name, help, "gauge", nil), f: f})
+}
+
+// Histogram adds a histogram with the given bucket upper bounds, partitioned by the given label names.
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{family: newFamily(name, help, "histogram", labels), buckets: append([]float64(nil), buckets...)}
+	sort.Float64s(h.buckets)
+	r.register(h)
+	return h
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.lock.Unlock()
+	counter := &countingWriter{w: w}
+	bw := bufio.NewWriter(counter)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return counter.n, err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// family is the name, help and labels shared by every series of a metric
+type family struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	lock       sync.Mutex
+	series     map[string]interface{}
+	// order holds the keys of series in the order they were created, so the output is stable
+	order []string
+}
+
+func newFamily(name string, help string, kind string, labelNames []string) family {
+	return family{name: name, help: help, kind: kind, labelNames: labelNames, series: make(map[string]interface{})}
+}
+
+// get returns the series for the label values, creating it with create if it's new
+func (f *family) get(values []string, create func() interface{}) interface{} {
+	if len(values) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", f.name, len(f.labelNames), len(values)))
+	}
+	key := f.labels(values, "", "")
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	s, prs := f.series[key]
+	if !prs {
+		s = create()
+		f.series[key] = s
+		f.order = append(f.order, key)
+	}
+	return s
+}
+
+// each calls fn with the formatted labels and value of each series
+func (f *family) each(fn func(labels string, s interface{})) {
+	f.lock.Lock()
+	order := append([]string(nil), f.order...)
+	series := make([]interface{}, len(order))
+	for i, key := range order {
+		series[i] = f.series[key]
+	}
+	f.lock.Unlock()
+	for i, key := range order {
+		fn(key, series[i])
+	}
+}
+
+func (f *family) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+}
+
+// labels formats the label values as {name="value",...}, with an extra label added if extraName is set
+func (f *family) labels(values []string, extraName string, extraValue string) string {
+	if len(values) == 0 && extraName == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range f.labelNames {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, escapeLabel(values[i]))
+	}
+	if extraName != "" {
+		if len(values) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", extraName, escapeLabel(extraValue))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	family
+}
+
+// With returns the counter for the given label values, in the order the label names were given.
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.get(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.each(func(labels string, s interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labels, formatValue(s.(*Counter).value.load()))
+	})
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	value atomicFloat
+}
+
+func (c *Counter) Inc() {
+	c.value.add(1)
+}
+
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("counters can't go down")
+	}
+	c.value.add(v)
+}
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct {
+	family
+}
+
+// With returns the gauge for the given label values, in the order the label names were given.
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return g.get(values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	g.each(func(labels string, s interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labels, formatValue(s.(*Gauge).value.load()))
+	})
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	value atomicFloat
+}
+
+func (g *Gauge) Inc() {
+	g.value.add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.value.add(-1)
+}
+
+func (g *Gauge) Set(v float64) {
+	g.value.store(v)
+}
+
+type gaugeFunc struct {
+	family
+	f func() float64
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.f()))
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	family
+	buckets []float64
+}
+
+// With returns the histogram for the given label values, in the order the label names were given.
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.get(values, func() interface{} {
+		return &Histogram{buckets: h.buckets, counts: make([]uint64, len(h.buckets)), values: values}
+	}).(*Histogram)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.each(func(labels string, s interface{}) {
+		hist := s.(*Histogram)
+		hist.lock.Lock()
+		counts := append([]uint64(nil), hist.counts...)
+		count, sum := hist.count, hist.sum
+		hist.lock.Unlock()
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(hist.values, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(hist.values, "le", "+Inf"), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatValue(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, count)
+	})
+}
+
+// Histogram counts observations into buckets
+type Histogram struct {
+	buckets []float64
+	values  []string
+	lock    sync.Mutex
+	// counts holds the observations falling in each bucket, not including those in lower buckets
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// atomicFloat is a float64 that can be updated from several goroutines without a lock
+type atomicFloat struct {
+	bits uint64
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+func (f *atomicFloat) store(v float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(v))
+}
+
+func (f *atomicFloat) add(v float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		updated := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&f.bits, old, updated) {
+			return
+		}
+	}
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_Counter(t *testing.T) {
+	sut := NewRegistry()
+	requests := sut.Counter("requests_total", "Requests received.", "opcode")
+	requests.With("RRQ").Inc()
+	requests.With("RRQ").Add(2)
+	requests.With("WRQ").Inc()
+
+	assertExposition(t, sut,
+		"# HELP requests_total Requests received.\n"+
+			"# TYPE requests_total counter\n"+
+			"requests_total{opcode=\"RRQ\"} 3\n"+
+			"requests_total{opcode=\"WRQ\"} 1\n")
+}
+
+func TestRegistry_GaugeAndGaugeFunc(t *testing.T) {
+	sut := NewRegistry()
+	active := sut.Gauge("active", "Active sessions.").With()
+	active.Inc()
+	active.Inc()
+	active.Dec()
+	sut.GaugeFunc("files", "Files held.", func() float64 { return 42 })
+
+	assertExposition(t, sut,
+		"# HELP active Active sessions.\n"+
+			"# TYPE active gauge\n"+
+			"active 1\n"+
+			"# HELP files Files held.\n"+
+			"# TYPE files gauge\n"+
+			"files 42\n")
+}
+
+func TestRegistry_Histogram(t *testing.T) {
+	sut := NewRegistry()
+	duration := sut.Histogram("duration_seconds", "Durations.", []float64{1, 0.1}, "direction")
+	duration.With("read").Observe(0.05)
+	duration.With("read").Observe(0.5)
+	duration.With("read").Observe(5)
+
+	assertExposition(t, sut,
+		"# HELP duration_seconds Durations.\n"+
+			"# TYPE duration_seconds histogram\n"+
+			"duration_seconds_bucket{direction=\"read\",le=\"0.1\"} 1\n"+
+			"duration_seconds_bucket{direction=\"read\",le=\"1\"} 2\n"+
+			"duration_seconds_bucket{direction=\"read\",le=\"+Inf\"} 3\n"+
+			"duration_seconds_sum{direction=\"read\"} 5.55\n"+
+			"duration_seconds_count{direction=\"read\"} 3\n")
+}
+
+func TestRegistry_EscapesLabels(t *testing.T) {
+	sut := NewRegistry()
+	sut.Counter("c", "Help.", "name").With("a\"b\\c\nd").Inc()
+
+	var out bytes.Buffer
+	sut.WriteTo(&out)
+
+	if !strings.Contains(out.String(), `c{name="a\"b\\c\nd"} 1`) {
+		t.Error("Label not escaped", out.String())
+	}
+}
+
+func assertExposition(t *testing.T, sut *Registry, expected string) {
+	t.Helper()
+	var out bytes.Buffer
+	if _, err := sut.WriteTo(&out); err != nil {
+		t.Fatal("Write failed", err)
+	}
+	if out.String() != expected {
+		t.Errorf("Exposition incorrect, got:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// mirror writes copies of uploaded files to a directory on disk, using the TFTP filename as the path within it
+type mirror struct {
+	dir string
+}
+
+// mirrorFile is a mirrored copy being written. It goes to a temporary file, which is only renamed into place once
+// committed, so the mirror never holds a partial upload.
+type mirrorFile struct {
+	tmp    *os.File
+	target string
+}
+
+// create starts replacing the mirrored copy of filename
+func (m mirror) create(filename string) (*mirrorFile, error) {
+	target, err := m.path(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	return &mirrorFile{tmp: tmp, target: target}, nil
+}
+
+func (f *mirrorFile) Write(p []byte) (int, error) {
+	return f.tmp.Write(p)
+}
+
+func (f *mirrorFile) Commit() error {
+	defer os.Remove(f.tmp.Name())
+	err := f.tmp.Sync()
+	if closeErr := f.tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.tmp.Name(), f.target)
+}
+
+func (f *mirrorFile) Abort() {
+	f.tmp.Close()
+	os.Remove(f.tmp.Name())
+}
+
+// mirroredUpload writes an upload to the mirror as well as the store. The store is what the client is told about, so
+// the mirror failing is only logged.
+type mirroredUpload struct {
+	FileWriter
+	mirror    *mirrorFile
+	mirrorErr error
+	logger    *slog.Logger
+}
+
+func (u *mirroredUpload) Write(p []byte) (int, error) {
+	n, err := u.FileWriter.Write(p)
+	if err == nil && u.mirrorErr == nil {
+		_, u.mirrorErr = u.mirror.Write(p)
+	}
+	return n, err
+}
+
+func (u *mirroredUpload) Commit() error {
+	if err := u.FileWriter.Commit(); err != nil {
+		u.mirror.Abort()
+		return err
+	}
+	if u.mirrorErr != nil {
+		u.mirror.Abort()
+		u.logger.Error("Unable to mirror", "error", u.mirrorErr)
+	} else if err := u.mirror.Commit(); err != nil {
+		u.logger.Error("Unable to mirror", "error", err)
+	}
+	return nil
+}
+
+func (u *mirroredUpload) Abort() {
+	u.FileWriter.Abort()
+	u.mirror.Abort()
+}
+
+// path maps filename into the mirror directory. Leading slashes and '..' elements can't take the file outside it
+func (m mirror) path(filename string) (string, error) {
+	cleaned := strings.TrimPrefix(path.Clean("/"+filename), "/")
+	if cleaned == "" {
+		return "", errors.New("filename has no path within the mirror directory")
+	}
+	return filepath.Join(m.dir, filepath.FromSlash(cleaned)), nil
+}
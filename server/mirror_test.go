@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMirror_Commit(t *testing.T) {
+	dir := t.TempDir()
+	sut := mirror{dir: dir}
+
+	if err := mirrorCopy(sut, "switches/core1.cfg", []byte("hostname core1")); err != nil {
+		t.Fatal("Commit failed", err)
+	}
+
+	assertFileContents(t, filepath.Join(dir, "switches", "core1.cfg"), []byte("hostname core1"))
+}
+
+func TestMirror_CommitReplaces(t *testing.T) {
+	dir := t.TempDir()
+	sut := mirror{dir: dir}
+	mirrorCopy(sut, "core1.cfg", []byte("first"))
+
+	if err := mirrorCopy(sut, "core1.cfg", []byte("second")); err != nil {
+		t.Fatal("Commit failed", err)
+	}
+
+	assertFileContents(t, filepath.Join(dir, "core1.cfg"), []byte("second"))
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Error("Temporary files left behind", entries)
+	}
+}
+
+func TestMirror_AbortLeavesPreviousCopy(t *testing.T) {
+	dir := t.TempDir()
+	sut := mirror{dir: dir}
+	mirrorCopy(sut, "core1.cfg", []byte("first"))
+	f, err := sut.create("core1.cfg")
+	if err != nil {
+		t.Fatal("Create failed", err)
+	}
+	f.Write([]byte("partial"))
+
+	f.Abort()
+
+	assertFileContents(t, filepath.Join(dir, "core1.cfg"), []byte("first"))
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Error("Temporary files left behind", entries)
+	}
+}
+
+func TestMirror_PathStaysInDir(t *testing.T) {
+	sut := mirror{dir: "/mirror"}
+
+	for _, filename := range []string{"../../etc/passwd", "/etc/passwd", "a/../../etc/passwd"} {
+		target, err := sut.path(filename)
+		if err != nil {
+			t.Error("Unexpected error", filename, err)
+		} else if target != filepath.FromSlash("/mirror/etc/passwd") {
+			t.Error("Path escaped mirror directory", filename, target)
+		}
+	}
+	if _, err := sut.path("/"); err == nil {
+		t.Error("Expected an error for a filename without a path")
+	}
+}
+
+// mirrorCopy writes contents to the mirrored copy of filename, as an upload does
+func mirrorCopy(m mirror, filename string, contents []byte) error {
+	f, err := m.create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(contents); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Commit()
+}
+
+func assertFileContents(t *testing.T, path string, expected []byte) {
+	t.Helper()
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Error("Unable to read file", path, err)
+	} else if !bytes.Equal(contents, expected) {
+		t.Error("File contents incorrect", path, contents)
+	}
+}
@@ -16,6 +16,22 @@ const (
 	ERROR OpCode = 5
 )
 
+func (code OpCode) String() string {
+	switch code {
+	case READ:
+		return "RRQ"
+	case WRITE:
+		return "WRQ"
+	case DATA:
+		return "DATA"
+	case ACK:
+		return "ACK"
+	case ERROR:
+		return "ERROR"
+	}
+	return "unknown"
+}
+
 type Packet interface {
 	Bytes() []byte
 }
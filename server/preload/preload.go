@@ -0,0 +1,107 @@
+package preload
+
+import (
+	"errors"
+	"github.com/sblundy/inmemorytftp/server/store"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Options controls which files Load puts in the store.
+//
+// Patterns use path.Match syntax. A pattern containing a '/' is matched against the whole relative path, otherwise
+// it's matched against the file's base name, so "*.img" selects images at any depth.
+type Options struct {
+	// Include limits loading to files matching at least one pattern. When empty, every file is included
+	Include []string
+	// Exclude skips files matching any pattern, even if they're included
+	Exclude []string
+	// MaxSize skips files larger than this many bytes. Zero means no limit
+	MaxSize int64
+}
+
+// Load walks dir and puts every selected file in the store, using its slash separated path relative to dir as the
+// filename. Symlinks to files are followed, but symlinked directories aren't descended into. Files that can't be read
+// are logged and skipped. It returns the number of files loaded.
+func Load(dir string, files store.Store, opts Options) (int, error) {
+	loaded := 0
+	err := filepath.WalkDir(dir, func(fullPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if fullPath == dir {
+				return err
+			}
+			slog.Warn("Unable to read", "path", fullPath, "error", err)
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		filename, ok := opts.Filename(dir, fullPath)
+		if !ok {
+			return nil
+		}
+		// Stat follows symlinks, as the watcher does, so a symlinked file is loaded the same way whichever sees it
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			slog.Warn("Unable to read", "path", fullPath, "error", err)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			if entry.Type()&fs.ModeSymlink != 0 {
+				slog.Warn("Skipping symlink to something other than a file", "path", fullPath)
+			}
+			return nil
+		}
+		if opts.MaxSize > 0 && info.Size() > opts.MaxSize {
+			slog.Warn("Skipping file larger than limit", "path", fullPath, "size", info.Size())
+			return nil
+		}
+		contents, err := os.ReadFile(fullPath)
+		if err != nil {
+			slog.Warn("Unable to read", "path", fullPath, "error", err)
+			return nil
+		}
+		if err := files.Put(filename, contents); errors.Is(err, store.ErrTooLarge) {
+			slog.Warn("Skipping file larger than the store's memory budget", "path", fullPath, "size", len(contents))
+			return nil
+		} else if err != nil {
+			return err
+		}
+		loaded++
+		return nil
+	})
+	return loaded, err
+}
+
+// Filename returns the TFTP filename for the file at fullPath within dir, and whether the options select it.
+func (opts Options) Filename(dir string, fullPath string) (string, bool) {
+	rel, err := filepath.Rel(dir, fullPath)
+	if err != nil {
+		return "", false
+	}
+	filename := filepath.ToSlash(rel)
+	if len(opts.Include) > 0 && !matchesAny(opts.Include, filename) {
+		return "", false
+	}
+	if matchesAny(opts.Exclude, filename) {
+		return "", false
+	}
+	return filename, true
+}
+
+func matchesAny(patterns []string, filename string) bool {
+	for _, pattern := range patterns {
+		target := filename
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(filename)
+		}
+		if matched, _ := path.Match(pattern, target); matched {
+			return true
+		}
+	}
+	return false
+}
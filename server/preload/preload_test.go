@@ -0,0 +1,128 @@
+package preload
+
+import (
+	"bytes"
+	"github.com/sblundy/inmemorytftp/server/store"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoad_RelativeFilenames(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "pxelinux.0", "boot")
+	writeTestFile(t, dir, "images/kernel.img", "kernel")
+	files := store.New()
+
+	n, err := Load(dir, files, Options{})
+
+	if err != nil || n != 2 {
+		t.Fatal("Load failed", n, err)
+	}
+	assertStored(t, files, "pxelinux.0", "boot")
+	assertStored(t, files, "images/kernel.img", "kernel")
+}
+
+func TestLoad_IncludeExclude(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "images/kernel.img", "kernel")
+	writeTestFile(t, dir, "images/old.img", "old")
+	writeTestFile(t, dir, "README.txt", "readme")
+	files := store.New()
+
+	n, err := Load(dir, files, Options{Include: []string{"*.img"}, Exclude: []string{"images/old.*"}})
+
+	if err != nil || n != 1 {
+		t.Fatal("Load failed", n, err)
+	}
+	assertStored(t, files, "images/kernel.img", "kernel")
+	assertNotStored(t, files, "images/old.img")
+	assertNotStored(t, files, "README.txt")
+}
+
+func TestLoad_MaxSize(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "small.txt", "1234")
+	writeTestFile(t, dir, "large.txt", "12345")
+	files := store.New()
+
+	n, err := Load(dir, files, Options{MaxSize: 4})
+
+	if err != nil || n != 1 {
+		t.Fatal("Load failed", n, err)
+	}
+	assertStored(t, files, "small.txt", "1234")
+	assertNotStored(t, files, "large.txt")
+}
+
+func TestLoad_SkipsFilesLargerThanBudget(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "small.txt", "1234")
+	writeTestFile(t, dir, "large.txt", "larger than the budget")
+	files := store.New(store.WithMemoryBudget(10))
+
+	n, err := Load(dir, files, Options{})
+
+	if err != nil || n != 1 {
+		t.Fatal("Load failed", n, err)
+	}
+	assertStored(t, files, "small.txt", "1234")
+	assertNotStored(t, files, "large.txt")
+}
+
+func TestLoad_Symlinks(t *testing.T) {
+	dir := t.TempDir()
+	target := t.TempDir()
+	writeTestFile(t, target, "kernel.img", "kernel")
+	writeTestFile(t, target, "images/initrd.img", "initrd")
+	os.Symlink(filepath.Join(target, "kernel.img"), filepath.Join(dir, "kernel.img"))
+	os.Symlink(filepath.Join(target, "images"), filepath.Join(dir, "images"))
+	os.Symlink(filepath.Join(target, "missing.img"), filepath.Join(dir, "broken.img"))
+	files := store.New()
+
+	n, err := Load(dir, files, Options{})
+
+	if err != nil || n != 1 {
+		t.Fatal("Load failed", n, err)
+	}
+	assertStored(t, files, "kernel.img", "kernel")
+	assertNotStored(t, files, "images")
+	assertNotStored(t, files, "images/initrd.img")
+	assertNotStored(t, files, "broken.img")
+}
+
+func TestLoad_MissingDir(t *testing.T) {
+	_, err := Load(filepath.Join(t.TempDir(), "missing"), store.New(), Options{})
+
+	if err == nil {
+		t.Error("Expected missing directory to fail")
+	}
+}
+
+func writeTestFile(t *testing.T, dir string, name string, contents string) {
+	t.Helper()
+	fullPath := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fullPath, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertStored(t *testing.T, files store.Store, filename string, expected string) {
+	t.Helper()
+	contents, prs := files.Get(filename)
+	if !prs {
+		t.Error("File missing", filename)
+	} else if !bytes.Equal(contents, []byte(expected)) {
+		t.Error("contents don't match", filename, contents)
+	}
+}
+
+func assertNotStored(t *testing.T, files store.Store, filename string) {
+	t.Helper()
+	if _, prs := files.Get(filename); prs {
+		t.Error("File not expected", filename)
+	}
+}
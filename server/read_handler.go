@@ -1,46 +1,52 @@
 package server
 
 import (
-	"fmt"
 	"github.com/sblundy/inmemorytftp/server/connection"
 	"github.com/sblundy/inmemorytftp/server/packets"
-	"log"
-	"os"
+	"io"
+	"log/slog"
 	"time"
 )
 
 const MaxPayloadSize = 512
-const readBlockTimeout = 30 * time.Second
 
-func HandleReadRequest(conn connection.TftpPacketConn, payload []byte) {
-	logger := log.New(os.Stdout, fmt.Sprintf("TftpServer.ReadRequest(%s->%s) ", conn.LocalAddr(), conn.RemoteAddr()), log.LstdFlags)
-	logger.Println("Start read")
-	var numBlocks = (uint16(len(payload) / MaxPayloadSize)) + 1
-	for blockId := uint16(1); blockId < numBlocks; blockId++ {
-		startIndex := (blockId - 1) * MaxPayloadSize
-		nextStartIndex := blockId * MaxPayloadSize
-		block := payload[startIndex:nextStartIndex]
-		if !sendBlock(conn, blockId, block, logger) {
-			logger.Println("ERROR: End send:failed")
-			return
+// HandleReadRequest sends payload to the client, returning whether every block was acknowledged. It's read a block at
+// a time as the transfer progresses, so a compressed file is only decompressed as fast as the client takes it.
+func HandleReadRequest(conn connection.TftpPacketConn, payload io.Reader, timeouts Timeouts, logger *slog.Logger) bool {
+	logger.Info("Start read")
+	for blockId := uint16(1); ; blockId++ {
+		// A new buffer for each block, as the packet sent keeps a reference to it
+		block := make([]byte, MaxPayloadSize)
+		n, err := io.ReadFull(payload, block)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			logger.Error("End read: unable to read file", "block", blockId, "error", err)
+			conn.Write(packets.NewError(0, "Unable to read file"))
+			return false
+		}
+		if !sendBlock(conn, blockId, block[:n], timeouts, logger) {
+			logger.Error("End read: send failed", "block", blockId)
+			return false
+		}
+		if n < MaxPayloadSize {
+			logger.Info("End read", "blocks", blockId)
+			return true
 		}
-	}
-	lastBlockStartIndex := (numBlocks - 1) * MaxPayloadSize
-	if !sendBlock(conn, numBlocks, payload[lastBlockStartIndex:], logger) {
-		logger.Println("ERROR: End send:failed")
-	} else {
-		logger.Println("End send")
 	}
 }
 
-func sendBlock(conn connection.TftpPacketConn, blockId uint16, block []byte, logger *log.Logger) bool {
-	deadline := time.Now().Add(readBlockTimeout)
+func sendBlock(conn connection.TftpPacketConn, blockId uint16, block []byte, timeouts Timeouts, logger *slog.Logger) bool {
+	deadline := time.Now().Add(timeouts.Block)
 	retry := 0
 	for time.Now().Before(deadline) {
-		result := trySendBlock(conn, blockId, block, logger)
+		result := trySendBlock(conn, blockId, block, timeouts, logger)
 		switch result {
 		case AckNotReceived:
 			retry++
+			if timeouts.retriesExhausted(retry) {
+				logger.Warn("Retries exhausted", "block", blockId, "retries", timeouts.Retries)
+				conn.Write(packets.NewError(5, "Send failed"))
+				return false
+			}
 		case AckReceived:
 			return true
 		case WriteFailed:
@@ -55,14 +61,14 @@ func sendBlock(conn connection.TftpPacketConn, blockId uint16, block []byte, log
 	return false
 }
 
-func trySendBlock(conn connection.TftpPacketConn, blockId uint16, block []byte, logger *log.Logger) responseType {
+func trySendBlock(conn connection.TftpPacketConn, blockId uint16, block []byte, timeouts Timeouts, logger *slog.Logger) responseType {
 	packet := packets.NewData(blockId, block)
 	ok := conn.Write(packet)
 	if !ok {
 		return WriteFailed
 	}
 
-	return receiveAck(conn, blockId, logger)
+	return receiveAck(conn, blockId, timeouts, logger)
 }
 
 type responseType int
@@ -75,15 +81,15 @@ const (
 	PrematureTermination
 )
 
-func receiveAck(conn connection.TftpPacketConn, block uint16, logger *log.Logger) responseType {
-	packet, ok := conn.Read(10 * time.Second)
+func receiveAck(conn connection.TftpPacketConn, block uint16, timeouts Timeouts, logger *slog.Logger) responseType {
+	packet, ok := conn.Read(timeouts.Ack)
 	if !ok {
 		return AckNotReceived
 	}
 
 	switch packet.(type) {
 	default:
-		logger.Println("WARN: Unexpected packet received")
+		logger.Warn("Unexpected packet received", "block", block, "packet", packet)
 	case packets.ErrorPacket:
 		return PrematureTermination
 	case packets.AckPacket:
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"container/list"
 	"github.com/sblundy/inmemorytftp/server/packets"
+	"log/slog"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -12,7 +14,7 @@ import (
 func TestHandleReadRequest_EmptyFile(t *testing.T) {
 	dummyConn := NewDummyPacketConn("TestHandleReadRequest_EmptyFile", packets.NewAck(1))
 
-	HandleReadRequest(&dummyConn, []byte{})
+	HandleReadRequest(&dummyConn, bytes.NewReader([]byte{}), DefaultTimeouts, testLogger)
 
 	assertNumSent(t, dummyConn.packetWritten, 1)
 	assertDataPacket(t, dummyConn.packetWritten.Front(), 1, []byte{})
@@ -22,7 +24,7 @@ func TestHandleReadRequest_OneUnderPacketSize(t *testing.T) {
 	dummyConn := NewDummyPacketConn("TestHandleReadRequest_OneUnderPacketSize", packets.NewAck(1))
 	file := strings.Repeat("1", MaxPayloadSize-1)
 
-	HandleReadRequest(&dummyConn, []byte(file))
+	HandleReadRequest(&dummyConn, bytes.NewReader([]byte(file)), DefaultTimeouts, testLogger)
 
 	assertNumSent(t, dummyConn.packetWritten, 1)
 	assertDataPacket(t, dummyConn.packetWritten.Front(), 1, []byte(file))
@@ -32,7 +34,7 @@ func TestHandleReadRequest_PacketSize(t *testing.T) {
 	dummyConn := NewDummyPacketConn("TestHandleReadRequest_PacketSize", packets.NewAck(1), packets.NewAck(2))
 	file := strings.Repeat("1", MaxPayloadSize)
 
-	HandleReadRequest(&dummyConn, []byte(file))
+	HandleReadRequest(&dummyConn, bytes.NewReader([]byte(file)), DefaultTimeouts, testLogger)
 
 	assertNumSent(t, dummyConn.packetWritten, 2)
 	assertDataPacket(t, dummyConn.packetWritten.Front(), 1, []byte(file))
@@ -42,7 +44,7 @@ func TestHandleReadRequest_PacketSize(t *testing.T) {
 func TestHandleReadRequest_Retry(t *testing.T) {
 	dummyConn := NewDummyPacketConn("TestHandleReadRequest_Retry", nil, packets.NewAck(1))
 
-	HandleReadRequest(&dummyConn, []byte{})
+	HandleReadRequest(&dummyConn, bytes.NewReader([]byte{}), DefaultTimeouts, testLogger)
 
 	assertNumSent(t, dummyConn.packetWritten, 2)
 	assertDataPacket(t, dummyConn.packetWritten.Front(), 1, []byte{})
@@ -55,25 +57,52 @@ func TestHandleReadRequest_Timeout(t *testing.T) {
 	}
 	dummyConn := NewDummyPacketConn("TestHandleReadRequest_ExhaustRetry")
 
-	HandleReadRequest(&dummyConn, []byte{})
+	HandleReadRequest(&dummyConn, bytes.NewReader([]byte{}), DefaultTimeouts, testLogger)
 
 	assertDataPacket(t, dummyConn.packetWritten.Front(), 1, []byte{})
 	assertErrorPacket(t, dummyConn.packetWritten.Back(), 5, "Send failed")
 }
 
+func TestHandleReadRequest_RetriesExhausted(t *testing.T) {
+	dummyConn := NewDummyPacketConn("TestHandleReadRequest_RetriesExhausted")
+	timeouts := DefaultTimeouts
+	timeouts.Retries = 1
+
+	ok := HandleReadRequest(&dummyConn, bytes.NewReader([]byte{}), timeouts, testLogger)
+
+	if ok {
+		t.Error("Expected the transfer to fail")
+	}
+	assertNumSent(t, dummyConn.packetWritten, 3)
+	assertDataPacket(t, dummyConn.packetWritten.Front(), 1, []byte{})
+	assertDataPacket(t, dummyConn.packetWritten.Front().Next(), 1, []byte{})
+	assertErrorPacket(t, dummyConn.packetWritten.Back(), 5, "Send failed")
+}
+
 func TestHandleReadRequest_PrematureTermination(t *testing.T) {
 	dummyConn := NewDummyPacketConn("TestHandleReadRequest_PrematureTermination",
 		packets.NewAck(1),
 		packets.NewError(3, "test"))
 	file := strings.Repeat("1", MaxPayloadSize)
 
-	HandleReadRequest(&dummyConn, []byte(file))
+	HandleReadRequest(&dummyConn, bytes.NewReader([]byte(file)), DefaultTimeouts, testLogger)
 
 	assertNumSent(t, dummyConn.packetWritten, 2)
 	assertDataPacket(t, dummyConn.packetWritten.Front(), 1, []byte(file))
 	assertDataPacket(t, dummyConn.packetWritten.Front().Next(), 2, []byte{})
 }
 
+func TestHandleReadRequest_MultipleBlocks(t *testing.T) {
+	dummyConn := NewDummyPacketConn("TestHandleReadRequest_MultipleBlocks", packets.NewAck(1), packets.NewAck(2))
+	file := []byte(strings.Repeat("1", MaxPayloadSize) + strings.Repeat("2", 10))
+
+	HandleReadRequest(&dummyConn, bytes.NewReader(file), DefaultTimeouts, testLogger)
+
+	assertNumSent(t, dummyConn.packetWritten, 2)
+	assertDataPacket(t, dummyConn.packetWritten.Front(), 1, file[:MaxPayloadSize])
+	assertDataPacket(t, dummyConn.packetWritten.Back(), 2, file[MaxPayloadSize:])
+}
+
 func assertNumSent(t *testing.T, actual *list.List, expected int) {
 	t.Helper()
 	if actual.Len() != expected {
@@ -113,6 +142,8 @@ func assertErrorPacket(t *testing.T, actual *list.Element, expectedCode uint16,
 	}
 }
 
+var testLogger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
 type DummyPacketConn struct {
 	id              string
 	packetsToBeRead []packets.Packet
@@ -1,47 +1,206 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"github.com/sblundy/inmemorytftp/server/acl"
+	"github.com/sblundy/inmemorytftp/server/audit"
 	"github.com/sblundy/inmemorytftp/server/connection"
+	"github.com/sblundy/inmemorytftp/server/metrics"
 	"github.com/sblundy/inmemorytftp/server/packets"
 	"github.com/sblundy/inmemorytftp/server/store"
-	"log"
+	"github.com/sblundy/inmemorytftp/server/tracing"
+	"log/slog"
 	"net"
-	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type TftpServer struct {
-	logger       *log.Logger
-	port         uint
-	run          bool
+	logger *slog.Logger
+	port   uint
+	// listenAddrs are the addresses requests are received on. Defaults to the port on every interface
+	listenAddrs []string
+	// run is cleared by Stop, to end the listeners
+	run          *atomic.Bool
 	runCheckFreq time.Duration
 	store        store.Store
-	done         chan bool
+	mirror       *mirror
+	registry     *metrics.Registry
+	metrics      *serverMetrics
+	auditLog     *audit.Log
+	active       *activeTransfers
+	observers    []Observer
+	tracer       *tracing.Tracer
+	// settings can be replaced while the server runs. See Reconfigure. Options change them in place, before the
+	// server is shared
+	settings *atomic.Pointer[Settings]
+	// sessions counts the transfers started, to give each an id for its log entries
+	sessions *uint64
+	// conns are the listen addresses bound by Bind
+	conns []net.PacketConn
+	// listening counts the listen addresses bound and still receiving requests
+	listening *int32
+	done      chan bool
 }
 
-func New(port uint, runCheckFreq time.Duration) TftpServer {
-	return TftpServer{
-		logger:       log.New(os.Stderr, "TftpServer ", log.LstdFlags),
+// Settings are the parts of the server's configuration that can be changed while it runs
+type Settings struct {
+	// ACL decides which requests are allowed. Nil allows every request
+	ACL *acl.ACL
+	// MaxSessions limits the transfers in progress at once. 0 for no limit
+	MaxSessions int
+	Timeouts    Timeouts
+}
+
+// Option customises a TftpServer created by New
+type Option func(*TftpServer)
+
+// WithStore makes the server use an existing store rather than creating an empty one
+func WithStore(st store.Store) Option {
+	return func(server *TftpServer) {
+		server.store = st
+	}
+}
+
+// WithMirror writes a copy of every uploaded file to dir, at the path given by its TFTP filename. Reads are still
+// served from the store.
+func WithMirror(dir string) Option {
+	return func(server *TftpServer) {
+		server.mirror = &mirror{dir: dir}
+	}
+}
+
+// WithLogger makes the server log to logger rather than slog's default logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(server *TftpServer) {
+		server.logger = logger
+	}
+}
+
+// WithAuditLog writes a record of every transfer to l, whether it completes or not.
+func WithAuditLog(l *audit.Log) Option {
+	return func(server *TftpServer) {
+		server.auditLog = l
+	}
+}
+
+// WithTracer traces each request with tracer, in a span covering the negotiation of the transfer and a span covering
+// the data being sent.
+func WithTracer(tracer *tracing.Tracer) Option {
+	return func(server *TftpServer) {
+		server.tracer = tracer
+	}
+}
+
+// WithListenAddrs receives requests on each of addrs, such as "192.0.2.1:69" or "[::1]:69", rather than on the port
+// given to New on every interface.
+func WithListenAddrs(addrs ...string) Option {
+	return func(server *TftpServer) {
+		server.listenAddrs = addrs
+	}
+}
+
+// WithACL refuses requests that acl doesn't allow with an access violation.
+func WithACL(acl *acl.ACL) Option {
+	return func(server *TftpServer) {
+		server.settings.Load().ACL = acl
+	}
+}
+
+// WithMaxSessions refuses requests while n transfers are already in progress, telling the client the server is busy.
+func WithMaxSessions(n int) Option {
+	return func(server *TftpServer) {
+		server.settings.Load().MaxSessions = n
+	}
+}
+
+// WithTimeouts replaces DefaultTimeouts
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(server *TftpServer) {
+		server.settings.Load().Timeouts = timeouts
+	}
+}
+
+// WithMetrics adds the server's metrics to reg, so they can be served alongside any others.
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(server *TftpServer) {
+		server.registry = reg
+	}
+}
+
+func New(port uint, runCheckFreq time.Duration, opts ...Option) TftpServer {
+	server := TftpServer{
+		logger:       slog.Default(),
 		port:         port,
-		run:          true,
+		run:          new(atomic.Bool),
 		runCheckFreq: runCheckFreq,
-		store:        store.New(),
+		sessions:     new(uint64),
+		listening:    new(int32),
+		settings:     new(atomic.Pointer[Settings]),
+		active:       &activeTransfers{transfers: make(map[uint64]*transfer)},
 		done:         make(chan bool),
 	}
+	server.run.Store(true)
+	server.settings.Store(&Settings{Timeouts: DefaultTimeouts})
+	for _, opt := range opts {
+		opt(&server)
+	}
+	if len(server.listenAddrs) == 0 {
+		server.listenAddrs = []string{fmt.Sprintf(":%d", port)}
+	}
+	if server.store == (store.Store{}) {
+		server.store = store.New()
+	}
+	if server.registry == nil {
+		server.registry = metrics.NewRegistry()
+	}
+	server.metrics = newServerMetrics(server.registry, server.store)
+	return server
 }
 
-func (server *TftpServer) Listen() {
-	listenAddr := fmt.Sprintf(":%d", server.port)
-	conn, err := net.ListenPacket("udp", listenAddr)
-	if err != nil {
-		server.logger.Fatalln("Unable to open port", server.port, err)
-		server.done <- true
-		return
+// Listen binds every listen address and receives requests on them until Stop is called. If an address can't be bound,
+// it returns the error straight away.
+func (server *TftpServer) Listen() error {
+	if err := server.Bind(); err != nil {
+		return err
 	}
+	server.Serve()
+	return nil
+}
+
+// Bind opens every listen address, ready for Serve. If any can't be bound, those already opened are closed again.
+func (server *TftpServer) Bind() error {
+	conns := make([]net.PacketConn, 0, len(server.listenAddrs))
+	for _, addr := range server.listenAddrs {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			for _, bound := range conns {
+				bound.Close()
+			}
+			return fmt.Errorf("unable to listen on %s: %w", addr, err)
+		}
+		conns = append(conns, conn)
+	}
+	server.conns = conns
+	atomic.StoreInt32(server.listening, int32(len(conns)))
+	return nil
+}
+
+// Serve receives requests on the addresses opened by Bind until Stop is called
+func (server *TftpServer) Serve() {
+	for _, conn := range server.conns[1:] {
+		go server.serve(conn)
+	}
+	server.serve(server.conns[0])
+}
+
+func (server *TftpServer) serve(conn net.PacketConn) {
 	defer conn.Close()
 
-	for server.run {
+	for server.run.Load() {
 		buff := make([]byte, 1024)
 
 		conn.SetReadDeadline(time.Now().Add(server.runCheckFreq))
@@ -50,35 +209,71 @@ func (server *TftpServer) Listen() {
 		if err != nil {
 			switch err.(type) {
 			default:
-				server.logger.Println("ERROR:", err.Error())
+				server.logger.Error("Unable to read packet", "error", err)
 			case *net.OpError:
 				opErr := err.(*net.OpError)
 				if opErr.Timeout() {
 					continue
+				} else if errors.Is(err, net.ErrClosed) {
+					// Nothing more can be received, so this address no longer counts as listening
+					server.logger.Error("Stopped listening", "addr", conn.LocalAddr().String(), "error", err)
+					atomic.AddInt32(server.listening, -1)
+					server.done <- true
+					return
 				} else {
-					server.logger.Println("ERROR:", err.Error())
+					server.logger.Error("Unable to read packet", "error", err)
 				}
 			}
 		} else if n == 0 {
-			server.logger.Println("WARN: Packet is empty", addr)
+			server.logger.Warn("Packet is empty", "client", addr.String())
 		} else if n < 2 {
-			server.logger.Println("WARN: Packet too short", addr)
+			server.logger.Warn("Packet too short", "client", addr.String())
 		} else {
 			go server.handlePacket(conn, buff[:n], addr)
 		}
 	}
+	atomic.AddInt32(server.listening, -1)
 	server.done <- true
 }
 
+// Listening returns whether every listen address is bound and receiving requests
+func (server *TftpServer) Listening() bool {
+	return int(atomic.LoadInt32(server.listening)) == len(server.listenAddrs)
+}
+
+// HasCapacity returns whether another transfer can start without exceeding the limit set by WithMaxSessions
+func (server *TftpServer) HasCapacity() bool {
+	return server.active.hasCapacity(server.Settings().MaxSessions)
+}
+
+// Settings returns the settings requests are currently handled with
+func (server *TftpServer) Settings() Settings {
+	return *server.settings.Load()
+}
+
+// Reconfigure replaces the settings for requests received from now on. Transfers already in progress carry on with
+// the timeouts they started with.
+func (server *TftpServer) Reconfigure(settings Settings) {
+	server.settings.Store(&settings)
+}
+
 func (server *TftpServer) Stop() {
-	server.run = false
-	<-server.done
+	server.run.Store(false)
+	for range server.listenAddrs {
+		<-server.done
+	}
 }
 
 func (server *TftpServer) handlePacket(conn net.PacketConn, buff []byte, addr net.Addr) {
-	server.logger.Println("Packet received", addr, buff)
+	opcode := packets.OpCode(0)
+	if buff[0] == 0 {
+		opcode = packets.OpCode(buff[1])
+	}
+	logger := server.logger.With("client", addr.String())
+	logger.Debug("Packet received", "opcode", opcode.String(), "size", len(buff))
+	server.metrics.requests.With(opcode.String()).Inc()
 	packet, ok := packets.Read(buff)
-	initialConnection := connection.WrapExisting(conn, addr)
+	initialConnection := reply{TftpReplyChannel: connection.WrapExisting(conn, addr, logger), metrics: server.metrics}
 	if ok {
 		switch packet.(type) {
 		default:
@@ -98,59 +293,129 @@ func (server *TftpServer) handlePacket(conn net.PacketConn, buff []byte, addr ne
 }
 
 func (server *TftpServer) handleDefault(replyChannel connection.TftpReplyChannel, packet packets.Packet) {
-	server.logger.Println("WARN: Unexpected packet received", packet)
+	server.logger.Warn("Unexpected packet received", "packet", packet)
 	replyChannel.Write(packets.NewError(4, "Not understood"))
 }
 
 func (server *TftpServer) onReadRequest(replyChannel connection.TftpReplyChannel, packet packets.ReadPacket, target net.Addr) {
-	fileBytes, prs := server.store.Get(packet.Filename)
+	req := server.receive(target, directionRead, packet.Filename, packet.Mode)
+	if !server.allowed(req) {
+		server.refuse(replyChannel, req, 2, "Access violation")
+		return
+	}
+	payload, meta, prs := server.store.Open(packet.Filename)
+	if !prs {
+		if filename, version, ok := splitVersion(packet.Filename); ok {
+			payload, meta, prs = server.store.OpenVersion(filename, version)
+		}
+	}
 	if !prs {
-		replyChannel.Write(packets.NewError(1, "File not found"))
+		server.refuse(replyChannel, req, 1, "File not found")
 		return
 	}
+	req.version, req.sha256 = meta.Version, meta.SHA256
 
-	conn, err := connection.New(target)
+	t, err := server.startTransfer(req)
 	if err != nil {
-		log.Println("Unable to open a local port!", err)
-		replyChannel.Write(packets.NewError(0, "Unable to open local port"))
+		server.refuseStart(replyChannel, req, err)
 		return
 	}
-	defer conn.Close()
-	HandleReadRequest(conn, fileBytes)
+	defer t.Close()
+	t.end(HandleReadRequest(t, payload, req.settings.Timeouts, t.logger))
+}
+
+// allowed returns whether the ACL allows the request. Every request is allowed without one
+func (server *TftpServer) allowed(req *request) bool {
+	if req.settings.ACL == nil {
+		return true
+	}
+	var ip net.IP
+	if addr, ok := req.client.(*net.UDPAddr); ok {
+		ip = addr.IP
+	}
+	if req.settings.ACL.Allowed(ip, req.direction, req.filename) {
+		return true
+	}
+	server.logger.Warn("Request denied by ACL", "client", req.client.String(), "direction", req.direction,
+		"filename", req.filename)
+	return false
+}
+
+// splitVersion splits a filename with a version suffix, such as "config.txt;3", into the filename and version.
+func splitVersion(filename string) (string, int, bool) {
+	i := strings.LastIndexByte(filename, ';')
+	if i <= 0 {
+		return "", 0, false
+	}
+	version, err := strconv.Atoi(filename[i+1:])
+	if err != nil || version < 1 {
+		return "", 0, false
+	}
+	return filename[:i], version, true
 }
 
 func (server *TftpServer) onWriteRequest(replyChannel connection.TftpReplyChannel, packet packets.WritePacket, sender net.Addr) {
-	server.logger.Println("in onData")
+	server.logger.Debug("Write request", "client", sender.String(), "filename", packet.Filename)
+	req := server.receive(sender, directionWrite, packet.Filename, packet.Mode)
 	if len(packet.Filename) == 0 {
-		replyChannel.Write(packets.NewError(4, "Zero length file name not allowed"))
+		server.refuse(replyChannel, req, 4, "Zero length file name not allowed")
+		return
+	}
+	if !server.allowed(req) {
+		server.refuse(replyChannel, req, 2, "Access violation")
 		return
 	}
 
-	conn, err := connection.New(sender)
+	t, err := server.startTransfer(req)
 	if err != nil {
-		log.Println("Unable to open a local port!", err)
-		replyChannel.Write(packets.NewError(0, "Unable to open local port"))
+		server.refuseStart(replyChannel, req, err)
 		return
 	}
-	defer conn.Close()
+	defer t.Close()
 
-	fileBytes, ok := HandleWriteRequest(conn, packet.Filename)
+	origin := store.Origin{Uploader: sender.String(), Mode: packet.Mode}
+	upload := &storedUpload{Upload: server.store.PutWriter(packet.Filename, origin)}
+	var w FileWriter = upload
+	if server.mirror != nil {
+		if f, err := server.mirror.create(packet.Filename); err != nil {
+			t.logger.Error("Unable to mirror", "error", err)
+		} else {
+			w = &mirroredUpload{FileWriter: w, mirror: f, logger: t.logger}
+		}
+	}
+	ok := HandleWriteRequest(t, w, req.settings.Timeouts, t.logger)
 	if ok {
-		server.store.Put(packet.Filename, fileBytes)
+		event := t.event(EventFileStored)
+		event.Version = upload.meta.Version
+		event.SHA256 = upload.meta.SHA256
+		server.emit(event)
 	}
+	t.end(ok)
+}
+
+// storedUpload is an upload that remembers the metadata of what it stored, so the event reports this upload even if
+// another has replaced it since
+type storedUpload struct {
+	*store.Upload
+	meta store.Metadata
+}
+
+func (u *storedUpload) Commit() (err error) {
+	u.meta, err = u.Upload.Commit()
+	return err
 }
 
 func (server *TftpServer) onData(replyChannel connection.TftpReplyChannel, packet packets.DataPacket) {
-	server.logger.Println("in onData")
+	server.logger.Debug("Unexpected DATA packet", "block", packet.Block)
 	replyChannel.Write(packets.NewError(5, "Data not expected"))
 }
 
 func (server *TftpServer) onAck(replyChannel connection.TftpReplyChannel, packet packets.AckPacket) {
-	server.logger.Println("in onAck")
+	server.logger.Debug("Unexpected ACK packet", "block", packet.Block)
 	//ignoring
 }
 
 func (server *TftpServer) onError(replyChannel connection.TftpReplyChannel, packet packets.ErrorPacket) {
-	server.logger.Println("in onError")
+	server.logger.Debug("Unexpected ERROR packet", "code", packet.ErrorCode, "message", packet.Message)
 	//ignoring
 }
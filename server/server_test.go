@@ -3,8 +3,11 @@ package server
 import (
 	"bytes"
 	"fmt"
+	"github.com/sblundy/inmemorytftp/server/acl"
+	"github.com/sblundy/inmemorytftp/server/packets"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path"
@@ -31,6 +34,89 @@ func TestTftpServer_Integration(t *testing.T) {
 	getDummyFile(t)
 }
 
+func TestTftpServer_Bind(t *testing.T) {
+	sut := New(0, 10*time.Millisecond, WithListenAddrs("127.0.0.1:0"))
+	if err := sut.Bind(); err != nil {
+		t.Fatal("Bind failed", err)
+	}
+	if !sut.Listening() {
+		t.Error("Expected to be listening once bound")
+	}
+	taken := sut.conns[0].LocalAddr().String()
+	go sut.Serve()
+
+	conflicting := New(0, 10*time.Millisecond, WithListenAddrs("127.0.0.1:0", taken))
+	if err := conflicting.Listen(); err == nil || !strings.Contains(err.Error(), taken) {
+		t.Error("Expected the address in use to be reported", err)
+	}
+	if conflicting.Listening() {
+		t.Error("Expected not to be listening after failing to bind")
+	}
+
+	sut.Stop()
+	if sut.Listening() {
+		t.Error("Expected not to be listening once stopped")
+	}
+}
+
+func TestTftpServer_ListeningEndsWhenClosed(t *testing.T) {
+	sut := New(0, 10*time.Millisecond, WithListenAddrs("127.0.0.1:0"))
+	if err := sut.Bind(); err != nil {
+		t.Fatal("Bind failed", err)
+	}
+	go sut.Serve()
+
+	sut.conns[0].Close()
+	sut.Stop()
+
+	if sut.Listening() {
+		t.Error("Expected a closed address not to count as listening")
+	}
+}
+
+func TestSplitVersion(t *testing.T) {
+	filename, version, ok := splitVersion("config.txt;3")
+	if !ok || filename != "config.txt" || version != 3 {
+		t.Error("Version not split", filename, version, ok)
+	}
+
+	for _, unversioned := range []string{"config.txt", "config.txt;", ";3", "config.txt;0", "config.txt;x"} {
+		if _, _, ok := splitVersion(unversioned); ok {
+			t.Error("Unexpected version", unversioned)
+		}
+	}
+}
+
+func TestTftpServer_ACL(t *testing.T) {
+	rule, _ := acl.NewRule("deny", []string{"192.0.2.0/24"}, acl.Write, "")
+	server := New(0, 0, WithACL(&acl.ACL{Rules: []acl.Rule{rule}, DefaultAllow: true}))
+	server.store.Put("test.txt", []byte("test"))
+
+	denied := NewDummyPacketConn("TestTftpServer_ACL")
+	server.onWriteRequest(&denied, packets.WritePacket{Filename: "test.txt", Mode: "octet"}, &net.UDPAddr{IP: net.ParseIP("192.0.2.1")})
+	assertNumSent(t, denied.packetWritten, 1)
+	assertErrorPacket(t, denied.packetWritten.Front(), 2, "Access violation")
+
+	empty := NewDummyPacketConn("TestTftpServer_ACL")
+	server.onWriteRequest(&empty, packets.WritePacket{Filename: "", Mode: "octet"}, &net.UDPAddr{IP: net.ParseIP("192.0.2.1")})
+	assertErrorPacket(t, empty.packetWritten.Front(), 4, "Zero length file name not allowed")
+}
+
+func TestTftpServer_Reconfigure(t *testing.T) {
+	server := New(0, 0, WithMaxSessions(2))
+	server.store.Put("test.txt", []byte("test"))
+	rule, _ := acl.NewRule("deny", nil, acl.Read, "")
+	server.Reconfigure(Settings{ACL: &acl.ACL{Rules: []acl.Rule{rule}, DefaultAllow: true}, Timeouts: DefaultTimeouts})
+
+	if settings := server.Settings(); settings.MaxSessions != 0 || settings.ACL == nil {
+		t.Errorf("Settings not replaced: %+v", settings)
+	}
+	denied := NewDummyPacketConn("TestTftpServer_Reconfigure")
+	server.onReadRequest(&denied, packets.ReadPacket{Filename: "test.txt", Mode: "octet"}, &net.UDPAddr{IP: net.ParseIP("192.0.2.1")})
+	assertNumSent(t, denied.packetWritten, 1)
+	assertErrorPacket(t, denied.packetWritten.Front(), 2, "Access violation")
+}
+
 func getNonExistentFile(t *testing.T) {
 	client := newTestClient(testPort, t)
 	defer client.Close()
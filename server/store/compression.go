@@ -0,0 +1,100 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// An entry is only kept compressed if that saves at least this fraction of its size. Below that, the CPU spent
+// decompressing it on every read isn't worth it.
+const minCompressionSaving = 0.1
+
+// minCompressibleSize is the size below which entries aren't worth trying to compress
+const minCompressibleSize = 1024
+
+// compress returns e with its data gzipped, if it's compressible enough to be worth it. It's slow for large contents,
+// so it mustn't be called with the store locked.
+func (e entry) compress() entry {
+	if e.compressionTried {
+		return e
+	}
+	e.compressionTried = true
+	if e.compressed || len(e.data) < minCompressibleSize {
+		return e
+	}
+	buff := bytes.NewBuffer(make([]byte, 0, len(e.data)/2))
+	w, _ := gzip.NewWriterLevel(buff, gzip.BestSpeed)
+	w.Write(e.data)
+	w.Close()
+	if float64(buff.Len()) > float64(len(e.data))*(1-minCompressionSaving) {
+		return e
+	}
+	e.data = buff.Bytes()
+	e.compressed = true
+	return e
+}
+
+// prepare compresses e if the store is configured to, before it's added to the store
+func (s *shared) prepare(e entry) entry {
+	if s.cfg.compress {
+		return e.compress()
+	}
+	return e
+}
+
+// prepareAll is prepare for every entry in st. Entries with the same contents share the outcome, so each distinct
+// contents is only compressed once.
+func (s *shared) prepareAll(st *state) {
+	if !s.cfg.compress {
+		return
+	}
+	prepared := make(map[string]entry)
+	prepare := func(e entry) entry {
+		if done, prs := prepared[e.meta.SHA256]; prs {
+			e.data, e.compressed, e.compressionTried = done.data, done.compressed, true
+			return e
+		}
+		e = e.compress()
+		prepared[e.meta.SHA256] = e
+		return e
+	}
+	for filename, e := range st.files {
+		st.files[filename] = prepare(e)
+	}
+	for _, versions := range st.history {
+		for i, old := range versions {
+			versions[i] = prepare(old)
+		}
+	}
+}
+
+// open returns a reader over the contents of e, decompressing them as they're read
+func (e entry) open() io.Reader {
+	if !e.compressed {
+		return bytes.NewReader(e.data)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(e.data))
+	if err != nil {
+		return errReader{err}
+	}
+	return r
+}
+
+// contents returns the whole contents of e
+func (e entry) contents() ([]byte, error) {
+	if !e.compressed {
+		return e.data, nil
+	}
+	buff := bytes.NewBuffer(make([]byte, 0, e.meta.Size))
+	_, err := io.Copy(buff, e.open())
+	return buff.Bytes(), err
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
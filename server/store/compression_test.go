@@ -0,0 +1,119 @@
+package store
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStore_CompressesCompressibleFiles(t *testing.T) {
+	sut := New(WithCompression())
+	contents := []byte(strings.Repeat("interface GigabitEthernet0/1\n", 1000))
+	sut.Put("switch.cfg", contents)
+
+	stats := sut.Stats()
+
+	if stats.PhysicalBytes >= stats.UniqueBytes || stats.CompressionRatio <= 1 {
+		t.Error("Expected file to be compressed", stats)
+	}
+	assertContents(t, &sut, "switch.cfg", contents)
+}
+
+func TestStore_LeavesIncompressibleFiles(t *testing.T) {
+	sut := New(WithCompression())
+	contents := make([]byte, 4096)
+	rand.Read(contents)
+	sut.Put("kernel.img", contents)
+
+	stats := sut.Stats()
+
+	if stats.PhysicalBytes != 4096 || stats.CompressionRatio != 1 {
+		t.Error("Expected file to be left uncompressed", stats)
+	}
+	assertContents(t, &sut, "kernel.img", contents)
+}
+
+func TestState_InternNeverCompresses(t *testing.T) {
+	st := newState(historyLimits{})
+	contents := []byte(strings.Repeat("1234567890", 1000))
+
+	e := st.intern(newEntry(contents, Origin{}))
+
+	if e.compressed || st.physicalBytes != int64(len(contents)) {
+		t.Error("Expected intern to hold the contents as given", e.compressed, st.physicalBytes)
+	}
+}
+
+func TestStore_CompressionOnlyTriedOnce(t *testing.T) {
+	sut := New(WithCompression())
+	contents := make([]byte, 4096)
+	rand.Read(contents)
+	sut.Put("kernel.img", contents)
+
+	e, _ := sut.shared.lookup("kernel.img", 0, false)
+
+	if e.compressed || !e.compressionTried {
+		t.Error("Expected compression to have been tried and rejected", e.compressed, e.compressionTried)
+	}
+}
+
+func TestStore_CompressedJournalReplay(t *testing.T) {
+	journal, err := OpenJournal(filepath.Join(t.TempDir(), "store.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	contents := []byte(strings.Repeat("1234567890", 1000))
+	original := New(WithJournal(journal, "", 0))
+	original.Put("test.txt", contents)
+
+	sut := New(WithCompression())
+	if err := sut.ReplayJournal(journal); err != nil {
+		t.Fatal("Replay failed", err)
+	}
+
+	assertContents(t, &sut, "test.txt", contents)
+	if stats := sut.Stats(); stats.CompressionRatio <= 1 {
+		t.Error("Expected replayed file to be compressed", stats)
+	}
+}
+
+func TestStore_OpenDecompresses(t *testing.T) {
+	sut := New(WithCompression())
+	contents := []byte(strings.Repeat("1234567890", 1000))
+	sut.Put("test.txt", contents)
+
+	r, meta, prs := sut.Open("test.txt")
+
+	if !prs {
+		t.Fatal("File missing")
+	}
+	read, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(read, contents) {
+		t.Error("Contents incorrect", err)
+	}
+	if meta.Size != int64(len(contents)) {
+		t.Error("Size should be uncompressed size", meta.Size)
+	}
+}
+
+func TestStore_CompressedSnapshotRoundTrip(t *testing.T) {
+	original := New(WithCompression())
+	contents := []byte(strings.Repeat("1234567890", 1000))
+	original.Put("test.txt", contents)
+	buff := bytes.NewBuffer([]byte{})
+	original.WriteSnapshot(buff)
+
+	sut := New(WithCompression())
+	if err := sut.ReadSnapshot(buff); err != nil {
+		t.Fatal("Restore failed", err)
+	}
+
+	assertContents(t, &sut, "test.txt", contents)
+	if stats := sut.Stats(); stats.CompressionRatio <= 1 {
+		t.Error("Expected restored file to be compressed", stats)
+	}
+}
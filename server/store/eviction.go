@@ -0,0 +1,136 @@
+package store
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	minExpiryCheckInterval = time.Second
+	maxExpiryCheckInterval = time.Minute
+)
+
+// ttlRule expires files whose names start with prefix once they've gone ttl without being replaced
+type ttlRule struct {
+	prefix string
+	ttl    time.Duration
+}
+
+// WithMemoryBudget evicts the least recently read files once the memory holding the store's contents goes over
+// maxBytes. A file that has never been read counts as read when it was stored. A file larger than maxBytes could only
+// be kept by evicting everything else, so it's refused with ErrTooLarge instead.
+func WithMemoryBudget(maxBytes int64) Option {
+	return func(cfg *config) {
+		cfg.memoryBudget = maxBytes
+	}
+}
+
+// tooLarge returns whether a file of size bytes is larger than the memory budget
+func (cfg *config) tooLarge(size int64) bool {
+	return cfg.memoryBudget > 0 && size > cfg.memoryBudget
+}
+
+// MemoryBudget returns the most memory the store's contents may use, or 0 if there's no limit. See WithMemoryBudget.
+func (store *Store) MemoryBudget() int64 {
+	return store.shared.cfg.memoryBudget
+}
+
+// WithTTL expires files whose names start with prefix once they've gone ttl since they were last stored. An empty
+// prefix matches every file. Where several prefixes match, the longest wins.
+func WithTTL(prefix string, ttl time.Duration) Option {
+	return func(cfg *config) {
+		cfg.ttls = append(cfg.ttls, ttlRule{prefix: prefix, ttl: ttl})
+	}
+}
+
+// ttl returns the time to live for filename, or 0 if it doesn't expire
+func (cfg *config) ttl(filename string) time.Duration {
+	var best *ttlRule
+	for i, rule := range cfg.ttls {
+		if strings.HasPrefix(filename, rule.prefix) && (best == nil || len(rule.prefix) > len(best.prefix)) {
+			best = &cfg.ttls[i]
+		}
+	}
+	if best == nil {
+		return 0
+	}
+	return best.ttl
+}
+
+func (cfg *config) expired(filename string, e entry, now time.Time) bool {
+	ttl := cfg.ttl(filename)
+	return ttl > 0 && now.Sub(e.meta.Modified) >= ttl
+}
+
+// expiryCheckInterval is how often to look for expired files, a tenth of the shortest TTL within sensible bounds
+func (cfg *config) expiryCheckInterval() time.Duration {
+	interval := maxExpiryCheckInterval
+	for _, rule := range cfg.ttls {
+		if rule.ttl > 0 && rule.ttl/10 < interval {
+			interval = rule.ttl / 10
+		}
+	}
+	if interval < minExpiryCheckInterval {
+		return minExpiryCheckInterval
+	}
+	return interval
+}
+
+// expireAll removes every expired file
+func (s *shared) expireAll(now time.Time) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	var expired []string
+	for filename, e := range s.st.files {
+		if s.cfg.expired(filename, e, now) {
+			expired = append(expired, filename)
+		}
+	}
+	for _, filename := range expired {
+		s.expire(filename)
+	}
+}
+
+func (s *shared) expire(filename string) {
+	if err := s.commitDelete(filename); err != nil {
+		slog.Error("Unable to expire", "filename", filename, "error", err)
+	} else {
+		slog.Info("Expired", "filename", filename)
+	}
+}
+
+// evictToBudget removes the least recently read files until the store fits in its memory budget. The file named keep,
+// which has just been stored, is never evicted. The caller must hold writeLock.
+func (s *shared) evictToBudget(keep string) {
+	cfg, st := &s.cfg, s.st
+	if cfg.memoryBudget <= 0 || st.physicalBytes <= cfg.memoryBudget {
+		return
+	}
+	candidates := make([]string, 0, len(st.files))
+	for filename := range st.files {
+		if filename != keep {
+			candidates = append(candidates, filename)
+		}
+	}
+	lastUsed := func(filename string) time.Time {
+		if read := st.files[filename].lastRead(); !read.IsZero() {
+			return read
+		}
+		return st.files[filename].meta.Modified
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return lastUsed(candidates[i]).Before(lastUsed(candidates[j]))
+	})
+	for _, filename := range candidates {
+		if st.physicalBytes <= cfg.memoryBudget {
+			return
+		}
+		if err := s.commitDelete(filename); err != nil {
+			slog.Error("Unable to evict", "filename", filename, "error", err)
+			return
+		}
+		slog.Info("Evicted to keep the store within its memory budget", "filename", filename, "budget", cfg.memoryBudget)
+	}
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStore_EvictsLeastRecentlyRead(t *testing.T) {
+	sut := New(WithMemoryBudget(20))
+	sut.Put("a.txt", []byte("aaaaaaaaaa"))
+	sut.Put("b.txt", []byte("bbbbbbbbbb"))
+	sut.Get("a.txt")
+
+	sut.Put("c.txt", []byte("cccccccccc"))
+
+	if _, prs := sut.Get("b.txt"); prs {
+		t.Error("Least recently read file should have been evicted")
+	}
+	assertContents(t, &sut, "a.txt", []byte("aaaaaaaaaa"))
+	assertContents(t, &sut, "c.txt", []byte("cccccccccc"))
+}
+
+func TestStore_NeverEvictsFileJustStored(t *testing.T) {
+	sut := New(WithMemoryBudget(10))
+	sut.Put("a.txt", []byte("aaaaa"))
+	sut.Get("a.txt")
+
+	sut.Put("b.txt", []byte("bbbbbbbbbb"))
+
+	assertContents(t, &sut, "b.txt", []byte("bbbbbbbbbb"))
+}
+
+func TestStore_RefusesFileLargerThanBudget(t *testing.T) {
+	sut := New(WithMemoryBudget(10))
+	sut.Put("a.txt", []byte("aaaaa"))
+	sut.Put("b.txt", []byte("bbbbb"))
+
+	if err := sut.Put("large.txt", []byte("more than ten bytes")); err != ErrTooLarge {
+		t.Error("Expected ErrTooLarge", err)
+	}
+	upload := sut.PutWriter("large.txt", Origin{})
+	if _, err := upload.Write([]byte("more than ten bytes")); err != ErrTooLarge {
+		t.Error("Expected ErrTooLarge from the upload", err)
+	}
+	upload.Abort()
+
+	if _, prs := sut.Stat("large.txt"); prs {
+		t.Error("Large file should not be stored")
+	}
+	assertContents(t, &sut, "a.txt", []byte("aaaaa"))
+	assertContents(t, &sut, "b.txt", []byte("bbbbb"))
+}
+
+func TestStore_ExpiresAfterTTL(t *testing.T) {
+	sut := New(WithTTL("scratch/", 20*time.Millisecond))
+	sut.Put("scratch/upload.bin", []byte("scratch"))
+	sut.Put("boot/kernel.img", []byte("kernel"))
+
+	time.Sleep(30 * time.Millisecond)
+
+	if _, prs := sut.Get("scratch/upload.bin"); prs {
+		t.Error("File should have expired")
+	}
+	assertContents(t, &sut, "boot/kernel.img", []byte("kernel"))
+}
+
+func TestConfig_LongestPrefixTTLWins(t *testing.T) {
+	cfg := config{}
+	WithTTL("", time.Hour)(&cfg)
+	WithTTL("scratch/", time.Minute)(&cfg)
+	WithTTL("scratch/keep/", 0)(&cfg)
+
+	if ttl := cfg.ttl("boot/kernel.img"); ttl != time.Hour {
+		t.Error("Global TTL not applied", ttl)
+	}
+	if ttl := cfg.ttl("scratch/upload.bin"); ttl != time.Minute {
+		t.Error("Prefix TTL not applied", ttl)
+	}
+	if ttl := cfg.ttl("scratch/keep/upload.bin"); ttl != 0 {
+		t.Error("Longest prefix should win", ttl)
+	}
+}
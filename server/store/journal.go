@@ -0,0 +1,340 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// A journal is an append-only file recording every change made to the store since the last snapshot. All integers
+// are big endian.
+//
+//	magic    [8]byte  "IMTFTPJN"
+//	version  uint16   currently 2
+//	base     uint64   the sequence number of the last change before the first record
+//	then one record per change:
+//	  op       byte     1 = put, 2 = delete, 3 = rename
+//	  seq      uint64   the sequence number of the change, one more than the record before
+//	  nameLen  uint16
+//	  name     [nameLen]byte
+//	  size     uint64   always 0 for a delete
+//	  contents [size]byte   the new name for a rename
+//	  metadata          see writeMetadata. Only present for a put
+//	  crc      uint32   CRC-32 (IEEE) of the preceding fields of the record
+//
+// A record that is cut short or fails its checksum can only be the result of a crash part way through an append. It
+// was never acknowledged, so it's dropped when the journal is replayed.
+//
+// A snapshot records the sequence number of the last change it holds, so records it already covers are skipped when
+// the journal is replayed. They're left behind if the server stops between a snapshot being saved and the journal
+// being truncated.
+const journalMagic = "IMTFTPJN"
+const journalVersion uint16 = 2
+const journalHeaderSize = int64(len(journalMagic) + 2 + 8)
+
+const (
+	journalPut    byte = 1
+	journalDelete byte = 2
+	journalRename byte = 3
+)
+
+var errTornRecord = errors.New("torn journal record")
+
+type Journal struct {
+	file *os.File
+	size int64
+	// seq is the sequence number of the last change recorded, or of the last change before the journal was truncated
+	seq uint64
+}
+
+type journalRecord struct {
+	op       byte
+	seq      uint64
+	filename string
+	entry    entry
+	// newName is what the file is renamed to, for a rename
+	newName string
+}
+
+func (record journalRecord) apply(st *state) {
+	switch record.op {
+	case journalPut:
+		st.put(record.filename, record.entry)
+	case journalDelete:
+		st.delete(record.filename)
+	case journalRename:
+		st.rename(record.filename, record.newName)
+	}
+	st.applied(record.seq)
+}
+
+// OpenJournal opens the journal at path, creating it if it doesn't exist.
+func OpenJournal(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	journal := &Journal{file: f, size: info.Size()}
+	if journal.size == 0 {
+		if err = journal.writeHeader(); err == nil {
+			// Otherwise a power loss could lose the new file, along with every record appended to it
+			err = syncDir(filepath.Dir(path))
+		}
+	} else if err = journal.checkHeader(); err == nil {
+		// Carry on numbering from the last record, so new records always follow those a snapshot may cover
+		err = journal.scan(func(record journalRecord) {
+			journal.seq = record.seq
+		})
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return journal, nil
+}
+
+func (journal *Journal) Close() error {
+	return journal.file.Close()
+}
+
+// ReplayJournal applies every change recorded in journal to the store, skipping any already held by a snapshot it was
+// loaded from. It should be called at startup, after any snapshot has been loaded and before the store is used.
+func (store *Store) ReplayJournal(journal *Journal) error {
+	s := store.shared
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	var records []journalRecord
+	skipped := 0
+	err := journal.scan(func(record journalRecord) {
+		if record.seq <= s.st.seq {
+			skipped++
+			return
+		}
+		if record.op != journalDelete && record.op != journalRename {
+			record.entry = s.prepare(record.entry)
+		}
+		records = append(records, record)
+	})
+	if err != nil {
+		return err
+	}
+	if skipped > 0 {
+		slog.Info("Skipped journal records already in the snapshot", "count", skipped)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, record := range records {
+		record.apply(s.st)
+	}
+	return nil
+}
+
+// writeHeader writes the journal's header, with the sequence number of the last change recorded as the base.
+func (journal *Journal) writeHeader() error {
+	header := bytes.NewBuffer([]byte(journalMagic))
+	binary.Write(header, binary.BigEndian, journalVersion)
+	binary.Write(header, binary.BigEndian, journal.seq)
+	if _, err := journal.file.WriteAt(header.Bytes(), 0); err != nil {
+		return err
+	}
+	if err := journal.file.Sync(); err != nil {
+		return err
+	}
+	if journal.size < journalHeaderSize {
+		journal.size = journalHeaderSize
+	}
+	return nil
+}
+
+func (journal *Journal) checkHeader() error {
+	header := make([]byte, journalHeaderSize)
+	if _, err := journal.file.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("unable to read journal header: %w", err)
+	}
+	if string(header[:len(journalMagic)]) != journalMagic {
+		return errors.New("not a journal file")
+	}
+	if version := binary.BigEndian.Uint16(header[len(journalMagic):]); version != journalVersion {
+		return fmt.Errorf("unsupported journal version %d", version)
+	}
+	journal.seq = binary.BigEndian.Uint64(header[len(journalMagic)+2:])
+	return nil
+}
+
+// scan calls fn with every complete record in the journal, in order. A torn record at the end is truncated away, so
+// later appends follow on from the last good record.
+func (journal *Journal) scan(fn func(journalRecord)) error {
+	r := bufio.NewReader(io.NewSectionReader(journal.file, journalHeaderSize, journal.size-journalHeaderSize))
+	offset := journalHeaderSize
+	for {
+		record, n, err := readJournalRecord(r)
+		if err == io.EOF {
+			return nil
+		} else if err == errTornRecord {
+			slog.Warn("Dropping torn journal record", "offset", offset)
+			if err := journal.file.Truncate(offset); err != nil {
+				return err
+			}
+			journal.size = offset
+			return nil
+		} else if err != nil {
+			return err
+		}
+		fn(record)
+		offset += n
+	}
+}
+
+func readJournalRecord(r io.Reader) (journalRecord, int64, error) {
+	crc := crc32.NewIEEE()
+	counted := &countingReader{r: r}
+	tr := io.TeeReader(counted, crc)
+	var op byte
+	if err := binary.Read(tr, binary.BigEndian, &op); err != nil {
+		return journalRecord{}, 0, err
+	}
+	var seq uint64
+	if err := binary.Read(tr, binary.BigEndian, &seq); err != nil {
+		return journalRecord{}, 0, tornRecordError(err)
+	}
+	var nameLen uint16
+	if err := binary.Read(tr, binary.BigEndian, &nameLen); err != nil {
+		return journalRecord{}, 0, tornRecordError(err)
+	}
+	name := make([]byte, nameLen)
+	if _, err := io.ReadFull(tr, name); err != nil {
+		return journalRecord{}, 0, tornRecordError(err)
+	}
+	var size uint64
+	if err := binary.Read(tr, binary.BigEndian, &size); err != nil {
+		return journalRecord{}, 0, tornRecordError(err)
+	}
+	contents, err := io.ReadAll(io.LimitReader(tr, int64(size)))
+	if err != nil {
+		return journalRecord{}, 0, err
+	}
+	if uint64(len(contents)) != size {
+		return journalRecord{}, 0, errTornRecord
+	}
+	record := journalRecord{op: op, seq: seq, filename: string(name)}
+	e := newEntry(contents, Origin{})
+	switch op {
+	default:
+		return journalRecord{}, 0, errTornRecord
+	case journalDelete:
+	case journalRename:
+		record.newName = string(contents)
+	case journalPut:
+		if e.meta, err = readMetadata(tr, contents); err != nil {
+			return journalRecord{}, 0, tornRecordError(err)
+		}
+	}
+	expected := crc.Sum32()
+	var checksum uint32
+	if err := binary.Read(counted, binary.BigEndian, &checksum); err != nil {
+		return journalRecord{}, 0, tornRecordError(err)
+	}
+	if checksum != expected {
+		return journalRecord{}, 0, errTornRecord
+	}
+	if op != journalRename {
+		record.entry = e
+	}
+	return record, counted.n, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func tornRecordError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errTornRecord
+	}
+	return err
+}
+
+// appendPut records a put and syncs it to disk, returning its sequence number.
+func (journal *Journal) appendPut(filename string, e entry) (uint64, error) {
+	return journal.append(journalRecord{op: journalPut, filename: filename, entry: e})
+}
+
+// appendDelete records a delete and syncs it to disk, returning its sequence number.
+func (journal *Journal) appendDelete(filename string) (uint64, error) {
+	return journal.append(journalRecord{op: journalDelete, filename: filename})
+}
+
+// appendRename records a rename and syncs it to disk, returning its sequence number.
+func (journal *Journal) appendRename(filename string, newName string) (uint64, error) {
+	return journal.append(journalRecord{op: journalRename, filename: filename, newName: newName})
+}
+
+func (journal *Journal) append(record journalRecord) (uint64, error) {
+	if len(record.filename) > 0xFFFF {
+		return 0, fmt.Errorf("filename too long for journal: %.32s...", record.filename)
+	}
+	contents := []byte(record.newName)
+	if record.op != journalRename {
+		var err error
+		if contents, err = record.entry.contents(); err != nil {
+			return 0, err
+		}
+	}
+	record.seq = journal.seq + 1
+	buff := bytes.NewBuffer(make([]byte, 0, len(record.filename)+len(contents)+64))
+	buff.WriteByte(record.op)
+	binary.Write(buff, binary.BigEndian, record.seq)
+	binary.Write(buff, binary.BigEndian, uint16(len(record.filename)))
+	buff.WriteString(record.filename)
+	binary.Write(buff, binary.BigEndian, uint64(len(contents)))
+	buff.Write(contents)
+	if record.op == journalPut {
+		writeMetadata(buff, record.entry.meta)
+	}
+	binary.Write(buff, binary.BigEndian, crc32.ChecksumIEEE(buff.Bytes()))
+
+	n, err := journal.file.WriteAt(buff.Bytes(), journal.size)
+	if err == nil {
+		err = journal.file.Sync()
+	}
+	if err != nil {
+		// Drop whatever part of the record made it to disk, so the journal doesn't end in a torn record
+		journal.file.Truncate(journal.size)
+		return 0, err
+	}
+	journal.size += int64(n)
+	journal.seq = record.seq
+	return record.seq, nil
+}
+
+// truncate discards every record, once they're all covered by a snapshot. The header is rewritten first, so if the
+// server stops before the records are discarded, the next record is still numbered after them.
+func (journal *Journal) truncate() error {
+	if err := journal.writeHeader(); err != nil {
+		return err
+	}
+	if err := journal.file.Truncate(journalHeaderSize); err != nil {
+		return err
+	}
+	journal.size = journalHeaderSize
+	return journal.file.Sync()
+}
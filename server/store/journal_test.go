@@ -0,0 +1,162 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournal_Replay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.journal")
+	journal := openTestJournal(t, path)
+	original := New(WithJournal(journal, "", 0))
+	original.Put("test.txt", []byte("first"))
+	original.Put("test.txt", []byte("second"))
+	original.Put("other.txt", []byte("other"))
+	original.Put("deleted.txt", []byte("deleted"))
+	original.Delete("deleted.txt")
+	original.Put("old.txt", []byte("renamed"))
+	original.Rename("old.txt", "renamed.txt")
+	journal.Close()
+
+	sut := New()
+	if err := sut.ReplayJournal(openTestJournal(t, path)); err != nil {
+		t.Fatal("Replay failed", err)
+	}
+
+	assertContents(t, &sut, "test.txt", []byte("second"))
+	assertContents(t, &sut, "other.txt", []byte("other"))
+	if _, prs := sut.Get("deleted.txt"); prs {
+		t.Error("Deleted file should not be replayed")
+	}
+	assertContents(t, &sut, "renamed.txt", []byte("renamed"))
+	if _, prs := sut.Get("old.txt"); prs {
+		t.Error("Renamed file should not be replayed under its old name")
+	}
+}
+
+func TestJournal_ReplayKeepsMetadata(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.journal")
+	journal := openTestJournal(t, path)
+	original := New(WithJournal(journal, "", 0))
+	original.PutFrom("test.txt", []byte("test value"), Origin{Uploader: "127.0.0.1:1234", Mode: "octet"})
+	expected, _ := original.Stat("test.txt")
+	journal.Close()
+
+	sut := New()
+	sut.ReplayJournal(openTestJournal(t, path))
+
+	actual, _ := sut.Stat("test.txt")
+	if !actual.Modified.Equal(expected.Modified) || actual.Uploader != expected.Uploader || actual.Mode != expected.Mode {
+		t.Error("Metadata not replayed", expected, actual)
+	}
+}
+
+func TestJournal_ReplayDropsTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.journal")
+	journal := openTestJournal(t, path)
+	original := New(WithJournal(journal, "", 0))
+	original.Put("test.txt", []byte("test value"))
+	original.Put("torn.txt", []byte("torn value"))
+	journal.Close()
+	info, _ := os.Stat(path)
+	os.Truncate(path, info.Size()-3)
+
+	journal = openTestJournal(t, path)
+	sut := New(WithJournal(journal, "", 0))
+	if err := sut.ReplayJournal(journal); err != nil {
+		t.Fatal("Replay failed", err)
+	}
+	sut.Put("after.txt", []byte("after"))
+	journal.Close()
+
+	assertContents(t, &sut, "test.txt", []byte("test value"))
+	if _, prs := sut.Get("torn.txt"); prs {
+		t.Error("Torn record should have been dropped")
+	}
+	replayed := New()
+	replayed.ReplayJournal(openTestJournal(t, path))
+	assertContents(t, &replayed, "after.txt", []byte("after"))
+}
+
+func TestJournal_CompactIntoSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	snapshotPath := filepath.Join(dir, "store.snapshot")
+	journalPath := filepath.Join(dir, "store.journal")
+	journal := openTestJournal(t, journalPath)
+	original := New(WithJournal(journal, snapshotPath, 1))
+	original.Put("test.txt", []byte("test value"))
+	journal.Close()
+
+	if info, _ := os.Stat(journalPath); info.Size() != journalHeaderSize {
+		t.Error("Journal not truncated after compaction", info.Size())
+	}
+	sut := New()
+	if err := sut.LoadSnapshot(snapshotPath); err != nil {
+		t.Fatal("Load failed", err)
+	}
+	assertContents(t, &sut, "test.txt", []byte("test value"))
+}
+
+func TestJournal_SkipsRecordsInSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	snapshotPath := filepath.Join(dir, "store.snapshot")
+	journalPath := filepath.Join(dir, "store.journal")
+	journal := openTestJournal(t, journalPath)
+	original := New(WithJournal(journal, snapshotPath, 0), WithHistory(5, 0))
+	original.Put("test.txt", []byte("first"))
+	original.Put("test.txt", []byte("second"))
+	// A snapshot saved elsewhere leaves the journal as it was, as if the server stopped before truncating it
+	if err := original.SaveSnapshot(filepath.Join(dir, "crashed.snapshot")); err != nil {
+		t.Fatal("Save failed", err)
+	}
+	os.Rename(filepath.Join(dir, "crashed.snapshot"), snapshotPath)
+	original.Put("test.txt", []byte("third"))
+	journal.Close()
+
+	sut := New(WithHistory(5, 0))
+	if err := sut.LoadSnapshot(snapshotPath); err != nil {
+		t.Fatal("Load failed", err)
+	}
+	if err := sut.ReplayJournal(openTestJournal(t, journalPath)); err != nil {
+		t.Fatal("Replay failed", err)
+	}
+
+	if versions := sut.Versions("test.txt"); len(versions) != 3 || versions[2].Version != 3 {
+		t.Error("Expected records in the snapshot to be skipped", versions)
+	}
+	assertContents(t, &sut, "test.txt", []byte("third"))
+}
+
+func TestJournal_NumberingContinuesAfterCompaction(t *testing.T) {
+	dir := t.TempDir()
+	snapshotPath := filepath.Join(dir, "store.snapshot")
+	journalPath := filepath.Join(dir, "store.journal")
+	journal := openTestJournal(t, journalPath)
+	original := New(WithJournal(journal, snapshotPath, 0))
+	original.Put("test.txt", []byte("first"))
+	original.SaveSnapshot(snapshotPath)
+	journal.Close()
+
+	journal = openTestJournal(t, journalPath)
+	restarted := New(WithJournal(journal, snapshotPath, 0))
+	restarted.LoadSnapshot(snapshotPath)
+	restarted.ReplayJournal(journal)
+	restarted.Put("after.txt", []byte("after"))
+	journal.Close()
+
+	sut := New()
+	sut.LoadSnapshot(snapshotPath)
+	sut.ReplayJournal(openTestJournal(t, journalPath))
+	assertContents(t, &sut, "test.txt", []byte("first"))
+	assertContents(t, &sut, "after.txt", []byte("after"))
+}
+
+func openTestJournal(t *testing.T, path string) *Journal {
+	t.Helper()
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal("Unable to open journal", err)
+	}
+	return journal
+}
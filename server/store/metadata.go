@@ -0,0 +1,142 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Metadata describes a file in the store
+type Metadata struct {
+	// Version counts the uploads of the file, starting from 1
+	Version  int       `json:"version"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+	Modified time.Time `json:"modified"`
+	// Uploader is the address of the client that last uploaded the file. Empty if it wasn't uploaded over TFTP
+	Uploader string `json:"uploader,omitempty"`
+	// Mode is the transfer mode of the last upload
+	Mode string `json:"mode,omitempty"`
+	// SHA256 is the hex encoded SHA-256 digest of the contents
+	SHA256 string `json:"sha256"`
+}
+
+// Origin describes where the contents passed to PutFrom came from
+type Origin struct {
+	Uploader string
+	Mode     string
+}
+
+type entry struct {
+	// data is the contents of the file, gzipped if compressed is set
+	data       []byte
+	compressed bool
+	// compressionTried is set once compress has been tried on data, so incompressible contents aren't gzipped again
+	compressionTried bool
+	meta             Metadata
+	// lastReadNanos is when the entry was last read, as Unix time in nanoseconds. It's shared by copies of the entry and
+	// updated atomically, as it changes while the store is only locked for reading.
+	lastReadNanos *int64
+}
+
+// touch records that the entry has just been read
+func (e entry) touch() {
+	if e.lastReadNanos != nil {
+		atomic.StoreInt64(e.lastReadNanos, time.Now().UnixNano())
+	}
+}
+
+// lastRead returns when the entry was last read, or the zero time if it hasn't been
+func (e entry) lastRead() time.Time {
+	if e.lastReadNanos == nil {
+		return time.Time{}
+	}
+	if nanos := atomic.LoadInt64(e.lastReadNanos); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
+
+// newEntry builds the entry for contents, leaving the timestamps to be set when it's added to the store
+func newEntry(contents []byte, origin Origin) entry {
+	digest := sha256.Sum256(contents)
+	return entryWithDigest(contents, digest[:], origin)
+}
+
+// entryWithDigest is newEntry for contents whose SHA-256 digest has already been calculated
+func entryWithDigest(contents []byte, digest []byte, origin Origin) entry {
+	return entry{
+		data: contents,
+		meta: Metadata{
+			Size:     int64(len(contents)),
+			Uploader: origin.Uploader,
+			Mode:     origin.Mode,
+			SHA256:   hex.EncodeToString(digest),
+		},
+	}
+}
+
+// Snapshots and the journal record metadata after the contents, big endian:
+//
+//	created     int64   Unix time in nanoseconds
+//	modified    int64   Unix time in nanoseconds
+//	uploaderLen uint16
+//	uploader    [uploaderLen]byte
+//	modeLen     uint16
+//	mode        [modeLen]byte
+//
+// Size and SHA256 aren't recorded, as they're recalculated from the contents.
+func writeMetadata(w io.Writer, meta Metadata) error {
+	values := []interface{}{
+		meta.Created.UnixNano(),
+		meta.Modified.UnixNano(),
+		uint16(len(meta.Uploader)),
+		[]byte(meta.Uploader),
+		uint16(len(meta.Mode)),
+		[]byte(meta.Mode),
+	}
+	for _, v := range values {
+		if err := binary.Write(w, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMetadata reads the metadata for contents written by writeMetadata
+func readMetadata(r io.Reader, contents []byte) (Metadata, error) {
+	var created, modified int64
+	if err := binary.Read(r, binary.BigEndian, &created); err != nil {
+		return Metadata{}, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &modified); err != nil {
+		return Metadata{}, err
+	}
+	uploader, err := readShortString(r)
+	if err != nil {
+		return Metadata{}, err
+	}
+	mode, err := readShortString(r)
+	if err != nil {
+		return Metadata{}, err
+	}
+	meta := newEntry(contents, Origin{Uploader: uploader, Mode: mode}).meta
+	meta.Created = time.Unix(0, created)
+	meta.Modified = time.Unix(0, modified)
+	return meta, nil
+}
+
+func readShortString(r io.Reader) (string, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", err
+	}
+	s := make([]byte, n)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
@@ -0,0 +1,313 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// A snapshot is a single file holding every file in the store. All integers are big endian.
+//
+//	magic    [8]byte  "IMTFTPSN"
+//	version  uint16   currently 2
+//	seq      uint64   the sequence number of the last journaled change held. See Journal
+//	then one record per version of each file, oldest first:
+//	  tag      byte     1
+//	  nameLen  uint16
+//	  name     [nameLen]byte
+//	  size     uint64
+//	  contents [size]byte
+//	  metadata          see writeMetadata
+//	  version  uint64
+//	  crc      uint32   CRC-32 (IEEE) of name followed by contents
+//	then the trailer:
+//	  tag      byte     0
+//	  count    uint64   number of file records
+//	  crc      uint32   CRC-32 (IEEE) of every preceding byte
+const snapshotMagic = "IMTFTPSN"
+const snapshotVersion uint16 = 2
+
+const (
+	snapshotEndTag  byte = 0
+	snapshotFileTag byte = 1
+)
+
+var ErrCorruptSnapshot = errors.New("snapshot is corrupt")
+
+// WriteSnapshot writes the entire contents of the store to w.
+func (store *Store) WriteSnapshot(w io.Writer) error {
+	return writeSnapshot(w, store.dump())
+}
+
+func writeSnapshot(w io.Writer, st *state) error {
+	sw := newSnapshotWriter(w)
+	sw.write([]byte(snapshotMagic))
+	sw.writeValue(snapshotVersion)
+	sw.writeValue(st.seq)
+	count := 0
+	for filename, e := range st.files {
+		for _, old := range st.history[filename] {
+			sw.writeFile(filename, old)
+			count++
+		}
+		sw.writeFile(filename, e)
+		count++
+	}
+	sw.writeValue(snapshotEndTag)
+	sw.writeValue(uint64(count))
+	return sw.finish()
+}
+
+// ReadSnapshot replaces the contents of the store with the snapshot read from r. The whole snapshot is validated
+// before the store is touched, so a corrupt snapshot leaves the store as it was.
+func (store *Store) ReadSnapshot(r io.Reader) error {
+	files, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+	store.replace(files)
+	return nil
+}
+
+// SaveSnapshot writes a snapshot to path. The snapshot is written to a temporary file in the same directory and
+// renamed over path, so an existing snapshot is never left half written. If the store has a journal, it is truncated
+// once the snapshot is in place.
+func (store *Store) SaveSnapshot(path string) error {
+	s := store.shared
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if path == s.cfg.snapshotPath {
+		return saveSnapshot(path, s.st, s.cfg.journal)
+	}
+	// Only a snapshot at the configured path makes the journal redundant
+	return saveSnapshot(path, s.st, nil)
+}
+
+// saveSnapshot is called with the store's writeLock held, so no changes can be made between the snapshot being
+// written and the journal being truncated.
+func saveSnapshot(path string, st *state, journal *Journal) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	buffered := bufio.NewWriter(tmp)
+	if err = writeSnapshot(buffered, st); err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// The rename must be on disk before the journal is truncated, or a power loss could leave the old snapshot with
+	// an empty journal
+	if err = syncDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if journal != nil {
+		return journal.truncate()
+	}
+	return nil
+}
+
+// syncDir flushes changes to the entries of dir, such as a file being created or renamed, to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// LoadSnapshot replaces the contents of the store with the snapshot at path.
+func (store *Store) LoadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return store.ReadSnapshot(bufio.NewReader(f))
+}
+
+type snapshotWriter struct {
+	w   io.Writer
+	crc hash.Hash32
+	err error
+}
+
+func newSnapshotWriter(w io.Writer) *snapshotWriter {
+	crc := crc32.NewIEEE()
+	return &snapshotWriter{w: io.MultiWriter(w, crc), crc: crc}
+}
+
+func (sw *snapshotWriter) write(b []byte) {
+	if sw.err == nil {
+		_, sw.err = sw.w.Write(b)
+	}
+}
+
+func (sw *snapshotWriter) writeValue(v interface{}) {
+	if sw.err == nil {
+		sw.err = binary.Write(sw.w, binary.BigEndian, v)
+	}
+}
+
+func (sw *snapshotWriter) writeFile(filename string, e entry) {
+	if len(filename) > 0xFFFF {
+		sw.err = fmt.Errorf("filename too long for snapshot: %.32s...", filename)
+		return
+	}
+	contents, err := e.contents()
+	if err != nil {
+		sw.err = err
+		return
+	}
+	sw.writeValue(snapshotFileTag)
+	sw.writeValue(uint16(len(filename)))
+	sw.write([]byte(filename))
+	sw.writeValue(uint64(len(contents)))
+	sw.write(contents)
+	if sw.err == nil {
+		sw.err = writeMetadata(sw.w, e.meta)
+	}
+	sw.writeValue(uint64(e.meta.Version))
+	sw.writeValue(entryChecksum(filename, contents))
+}
+
+func (sw *snapshotWriter) finish() error {
+	sw.writeValue(sw.crc.Sum32())
+	return sw.err
+}
+
+func entryChecksum(filename string, contents []byte) uint32 {
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(filename))
+	crc.Write(contents)
+	return crc.Sum32()
+}
+
+func readSnapshot(r io.Reader) (*state, error) {
+	crc := crc32.NewIEEE()
+	tr := io.TeeReader(r, crc)
+
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(tr, magic); err != nil {
+		return nil, snapshotReadError(err)
+	}
+	if string(magic) != snapshotMagic {
+		return nil, fmt.Errorf("not a snapshot file: %w", ErrCorruptSnapshot)
+	}
+	var version uint16
+	if err := binary.Read(tr, binary.BigEndian, &version); err != nil {
+		return nil, snapshotReadError(err)
+	}
+	if version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+
+	st := newState(historyLimits{})
+	if err := binary.Read(tr, binary.BigEndian, &st.seq); err != nil {
+		return nil, snapshotReadError(err)
+	}
+	count := uint64(0)
+	for {
+		var tag byte
+		if err := binary.Read(tr, binary.BigEndian, &tag); err != nil {
+			return nil, snapshotReadError(err)
+		}
+		switch tag {
+		default:
+			return nil, fmt.Errorf("unknown record tag %d: %w", tag, ErrCorruptSnapshot)
+		case snapshotEndTag:
+			var recorded uint64
+			if err := binary.Read(tr, binary.BigEndian, &recorded); err != nil {
+				return nil, snapshotReadError(err)
+			}
+			expected := crc.Sum32()
+			var actual uint32
+			if err := binary.Read(r, binary.BigEndian, &actual); err != nil {
+				return nil, snapshotReadError(err)
+			}
+			if recorded != count || expected != actual {
+				return nil, fmt.Errorf("trailer mismatch: %w", ErrCorruptSnapshot)
+			}
+			return st, nil
+		case snapshotFileTag:
+			filename, e, err := readSnapshotFile(tr)
+			if err != nil {
+				return nil, err
+			}
+			if previous, prs := st.files[filename]; prs {
+				st.history[filename] = append(st.history[filename], previous)
+			}
+			st.files[filename] = e
+			count++
+		}
+	}
+}
+
+func readSnapshotFile(r io.Reader) (string, entry, error) {
+	var nameLen uint16
+	if err := binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+		return "", entry{}, snapshotReadError(err)
+	}
+	name := make([]byte, nameLen)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return "", entry{}, snapshotReadError(err)
+	}
+	var size uint64
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return "", entry{}, snapshotReadError(err)
+	}
+	// Read through a LimitReader rather than allocating size bytes up front, so a corrupt size can't exhaust memory
+	contents, err := io.ReadAll(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return "", entry{}, snapshotReadError(err)
+	}
+	if uint64(len(contents)) != size {
+		return "", entry{}, snapshotReadError(io.ErrUnexpectedEOF)
+	}
+	e := newEntry(contents, Origin{})
+	if e.meta, err = readMetadata(r, contents); err != nil {
+		return "", entry{}, snapshotReadError(err)
+	}
+	var version uint64
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return "", entry{}, snapshotReadError(err)
+	}
+	e.meta.Version = int(version)
+	var checksum uint32
+	if err := binary.Read(r, binary.BigEndian, &checksum); err != nil {
+		return "", entry{}, snapshotReadError(err)
+	}
+	if checksum != entryChecksum(string(name), contents) {
+		return "", entry{}, fmt.Errorf("checksum mismatch for %q: %w", name, ErrCorruptSnapshot)
+	}
+	return string(name), e, nil
+}
+
+func snapshotReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("snapshot truncated: %w", ErrCorruptSnapshot)
+	}
+	return err
+}
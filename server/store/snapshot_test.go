@@ -0,0 +1,125 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore_SnapshotRoundTrip(t *testing.T) {
+	original := New()
+	original.Put("test.txt", []byte("test value"))
+	original.Put("dir/empty.bin", []byte{})
+	buff := bytes.NewBuffer([]byte{})
+
+	if err := original.WriteSnapshot(buff); err != nil {
+		t.Fatal("Snapshot failed", err)
+	}
+	sut := New()
+	sut.Put("stale.txt", []byte("stale"))
+	if err := sut.ReadSnapshot(buff); err != nil {
+		t.Fatal("Restore failed", err)
+	}
+
+	assertContents(t, &sut, "test.txt", []byte("test value"))
+	assertContents(t, &sut, "dir/empty.bin", []byte{})
+	if _, prs := sut.Get("stale.txt"); prs {
+		t.Error("Restore should replace existing files")
+	}
+}
+
+func TestStore_SnapshotKeepsMetadata(t *testing.T) {
+	original := New()
+	original.PutFrom("test.txt", []byte("test value"), Origin{Uploader: "127.0.0.1:1234", Mode: "octet"})
+	expected, _ := original.Stat("test.txt")
+	buff := bytes.NewBuffer([]byte{})
+	original.WriteSnapshot(buff)
+
+	sut := New()
+	if err := sut.ReadSnapshot(buff); err != nil {
+		t.Fatal("Restore failed", err)
+	}
+
+	actual, _ := sut.Stat("test.txt")
+	if !actual.Created.Equal(expected.Created) || !actual.Modified.Equal(expected.Modified) ||
+		actual.Uploader != expected.Uploader || actual.Mode != expected.Mode || actual.SHA256 != expected.SHA256 {
+		t.Error("Metadata not restored", expected, actual)
+	}
+}
+
+func TestStore_SnapshotKeepsHistory(t *testing.T) {
+	original := New(WithHistory(5, 0))
+	original.Put("test.txt", []byte("first"))
+	original.Put("test.txt", []byte("second"))
+	buff := bytes.NewBuffer([]byte{})
+	original.WriteSnapshot(buff)
+
+	sut := New(WithHistory(5, 0))
+	if err := sut.ReadSnapshot(buff); err != nil {
+		t.Fatal("Restore failed", err)
+	}
+
+	assertContents(t, &sut, "test.txt", []byte("second"))
+	if contents, prs := sut.GetVersion("test.txt", 1); !prs || !bytes.Equal(contents, []byte("first")) {
+		t.Error("History not restored", contents, prs)
+	}
+}
+
+func TestStore_SnapshotCorrupt(t *testing.T) {
+	original := New()
+	original.Put("test.txt", []byte("test value"))
+	buff := bytes.NewBuffer([]byte{})
+	original.WriteSnapshot(buff)
+	corrupted := buff.Bytes()
+	corrupted[bytes.Index(corrupted, []byte("test value"))] ^= 0xFF
+
+	sut := New()
+	sut.Put("existing.txt", []byte("existing"))
+	err := sut.ReadSnapshot(bytes.NewReader(corrupted))
+
+	if !errors.Is(err, ErrCorruptSnapshot) {
+		t.Error("Expected corrupt snapshot error", err)
+	}
+	assertContents(t, &sut, "existing.txt", []byte("existing"))
+}
+
+func TestStore_SnapshotTruncated(t *testing.T) {
+	original := New()
+	original.Put("test.txt", []byte("test value"))
+	buff := bytes.NewBuffer([]byte{})
+	original.WriteSnapshot(buff)
+
+	sut := New()
+	err := sut.ReadSnapshot(bytes.NewReader(buff.Bytes()[:buff.Len()-1]))
+
+	if !errors.Is(err, ErrCorruptSnapshot) {
+		t.Error("Expected corrupt snapshot error", err)
+	}
+}
+
+func TestStore_SaveLoadSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.snapshot")
+	original := New()
+	original.Put("test.txt", []byte("test value"))
+
+	if err := original.SaveSnapshot(path); err != nil {
+		t.Fatal("Save failed", err)
+	}
+	sut := New()
+	if err := sut.LoadSnapshot(path); err != nil {
+		t.Fatal("Load failed", err)
+	}
+
+	assertContents(t, &sut, "test.txt", []byte("test value"))
+}
+
+func assertContents(t *testing.T, sut *Store, filename string, expected []byte) {
+	t.Helper()
+	contents, prs := sut.Get(filename)
+	if !prs {
+		t.Error("File missing", filename)
+	} else if !bytes.Equal(contents, expected) {
+		t.Error("contents don't match", filename, contents)
+	}
+}
@@ -0,0 +1,281 @@
+package store
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// state is everything held in the store. The store's copy is guarded by its locks; other copies, such as one being
+// loaded from a snapshot, are owned by the code that made them.
+type state struct {
+	files map[string]entry
+	// history holds the older versions of each file, oldest first
+	history      map[string][]entry
+	historyBytes int64
+	limits       historyLimits
+	// blobs holds the contents of every version of every file, keyed by SHA-256, so identical contents are only held
+	// once however many files and versions share them
+	blobs         map[string]*blob
+	logicalBytes  int64
+	physicalBytes int64
+	// seq is the sequence number of the last journaled change applied. See Journal
+	seq uint64
+}
+
+type blob struct {
+	data       []byte
+	compressed bool
+	size       int64
+	refs       int
+}
+
+// Stats summarises the contents of the store
+type Stats struct {
+	// Files is the number of files, not counting older versions
+	Files int `json:"files"`
+	// Versions is the number of versions held across every file, including the latest
+	Versions int `json:"versions"`
+	// LogicalBytes is the total size of every version held
+	LogicalBytes int64 `json:"logicalBytes"`
+	// UniqueBytes is the size of the distinct contents held, once identical contents are shared
+	UniqueBytes int64 `json:"uniqueBytes"`
+	// PhysicalBytes is the memory used to hold the distinct contents, once compressed
+	PhysicalBytes int64 `json:"physicalBytes"`
+	// CompressionRatio is UniqueBytes over PhysicalBytes. 1 when nothing is compressed
+	CompressionRatio float64 `json:"compressionRatio"`
+}
+
+// historyLimits bounds the older versions kept. With the zero value, no history is kept.
+type historyLimits struct {
+	// versions is the number of older versions kept per file
+	versions int
+	// bytes is the total size of the older versions kept across every file. Zero means no limit
+	bytes int64
+}
+
+func newState(limits historyLimits) *state {
+	return &state{
+		files:   make(map[string]entry),
+		history: make(map[string][]entry),
+		limits:  limits,
+		blobs:   make(map[string]*blob),
+	}
+}
+
+// intern swaps the contents of e for an identical blob already held, if there is one, and counts the reference. It's
+// called with the store locked, so e must already have been compressed if it's going to be. See shared.prepare.
+func (st *state) intern(e entry) entry {
+	e.lastReadNanos = new(int64)
+	st.logicalBytes += e.meta.Size
+	if b, prs := st.blobs[e.meta.SHA256]; prs {
+		b.refs++
+		e.data = b.data
+		e.compressed = b.compressed
+		return e
+	}
+	st.blobs[e.meta.SHA256] = &blob{data: e.data, compressed: e.compressed, size: e.meta.Size, refs: 1}
+	st.physicalBytes += int64(len(e.data))
+	return e
+}
+
+// release drops a reference to the contents of e, once it's no longer held
+func (st *state) release(e entry) {
+	st.logicalBytes -= e.meta.Size
+	if b, prs := st.blobs[e.meta.SHA256]; prs {
+		b.refs--
+		if b.refs <= 0 {
+			delete(st.blobs, e.meta.SHA256)
+			st.physicalBytes -= int64(len(b.data))
+		}
+	}
+}
+
+// applied records that the change journaled with seq has been applied. Changes made without a journal have seq 0.
+func (st *state) applied(seq uint64) {
+	if seq > st.seq {
+		st.seq = seq
+	}
+}
+
+func (st *state) stats() Stats {
+	stats := Stats{Files: len(st.files), Versions: len(st.files), LogicalBytes: st.logicalBytes, PhysicalBytes: st.physicalBytes}
+	for _, versions := range st.history {
+		stats.Versions += len(versions)
+	}
+	for _, b := range st.blobs {
+		stats.UniqueBytes += b.size
+	}
+	stats.CompressionRatio = 1
+	if stats.PhysicalBytes > 0 {
+		stats.CompressionRatio = float64(stats.UniqueBytes) / float64(stats.PhysicalBytes)
+	}
+	return stats
+}
+
+// put makes e the latest version of filename, moving any existing version into the history. Versions are numbered
+// from one more than the version replaced, so replaying the same puts always numbers them the same way.
+func (st *state) put(filename string, e entry) {
+	e = st.intern(e)
+	e.meta.Version = 1
+	if previous, prs := st.files[filename]; prs {
+		e.meta.Version = previous.meta.Version + 1
+		st.addHistory(filename, previous)
+	}
+	st.files[filename] = e
+}
+
+// delete removes filename and all its history, returning whether it was present
+func (st *state) delete(filename string) bool {
+	latest, prs := st.files[filename]
+	if !prs {
+		return false
+	}
+	delete(st.files, filename)
+	st.release(latest)
+	for _, old := range st.history[filename] {
+		st.historyBytes -= old.meta.Size
+		st.release(old)
+	}
+	delete(st.history, filename)
+	return true
+}
+
+// rename moves filename and all its history to newName. Anything already under newName is deleted first, so its
+// contents are released.
+func (st *state) rename(filename string, newName string) {
+	latest, prs := st.files[filename]
+	if !prs || filename == newName {
+		return
+	}
+	st.delete(newName)
+	delete(st.files, filename)
+	st.files[newName] = latest
+	if versions, prs := st.history[filename]; prs {
+		delete(st.history, filename)
+		st.history[newName] = versions
+	}
+}
+
+// names returns the filenames starting with prefix, sorted
+func (st *state) names(prefix string) []string {
+	var names []string
+	for filename := range st.files {
+		if strings.HasPrefix(filename, prefix) {
+			names = append(names, filename)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// version returns the given version of filename, which may be the latest
+func (st *state) version(filename string, version int) (entry, bool) {
+	if latest, prs := st.files[filename]; prs && latest.meta.Version == version {
+		return latest, true
+	}
+	for _, old := range st.history[filename] {
+		if old.meta.Version == version {
+			return old, true
+		}
+	}
+	return entry{}, false
+}
+
+// versions returns the metadata of every version of filename held, oldest first
+func (st *state) versions(filename string) []Metadata {
+	latest, prs := st.files[filename]
+	if !prs {
+		return nil
+	}
+	var metas []Metadata
+	for _, old := range st.history[filename] {
+		metas = append(metas, old.meta)
+	}
+	return append(metas, latest.meta)
+}
+
+func (st *state) addHistory(filename string, old entry) {
+	if st.limits.versions <= 0 {
+		st.release(old)
+		return
+	}
+	versions := append(st.history[filename], old)
+	st.historyBytes += old.meta.Size
+	for len(versions) > st.limits.versions {
+		st.historyBytes -= versions[0].meta.Size
+		st.release(versions[0])
+		versions = versions[1:]
+	}
+	st.history[filename] = versions
+	st.trimHistory()
+}
+
+// trimHistory drops the oldest versions, across every file, until the history fits in its byte limit
+func (st *state) trimHistory() {
+	for st.limits.bytes > 0 && st.historyBytes > st.limits.bytes {
+		var oldestName string
+		var oldest *entry
+		for filename, versions := range st.history {
+			if len(versions) > 0 && (oldest == nil || versions[0].meta.Modified.Before(oldest.meta.Modified)) {
+				oldestName = filename
+				oldest = &versions[0]
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		slog.Info("Dropping version to keep history within its limit", "filename", oldestName, "version", oldest.meta.Version, "limit", st.limits.bytes)
+		st.historyBytes -= oldest.meta.Size
+		st.release(*oldest)
+		if len(st.history[oldestName]) == 1 {
+			delete(st.history, oldestName)
+		} else {
+			st.history[oldestName] = st.history[oldestName][1:]
+		}
+	}
+}
+
+// copy returns a copy that can be read while the original carries on changing. Contents are shared, as they're
+// never modified once stored. The copy doesn't track blobs, so it mustn't be changed.
+func (st *state) copy() *state {
+	copied := newState(st.limits)
+	for filename, e := range st.files {
+		copied.files[filename] = e
+	}
+	for filename, versions := range st.history {
+		copied.history[filename] = append([]entry(nil), versions...)
+	}
+	copied.historyBytes = st.historyBytes
+	copied.seq = st.seq
+	return copied
+}
+
+// adopt replaces the contents with those of other, applying this state's limits to them
+func (st *state) adopt(other *state) {
+	st.files = other.files
+	st.history = other.history
+	st.seq = other.seq
+	st.historyBytes = 0
+	st.blobs = make(map[string]*blob)
+	st.logicalBytes = 0
+	st.physicalBytes = 0
+	for filename, e := range st.files {
+		st.files[filename] = st.intern(e)
+	}
+	for filename, versions := range st.history {
+		if st.limits.versions <= 0 {
+			delete(st.history, filename)
+			continue
+		}
+		if len(versions) > st.limits.versions {
+			versions = versions[len(versions)-st.limits.versions:]
+			st.history[filename] = versions
+		}
+		for i, old := range versions {
+			versions[i] = st.intern(old)
+			st.historyBytes += old.meta.Size
+		}
+	}
+	st.trimHistory()
+}
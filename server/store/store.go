@@ -1,65 +1,345 @@
 package store
 
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("file not found")
+
+// ErrExists is returned when renaming a file to a name that's already in use
+var ErrExists = errors.New("file already exists")
+
+// ErrTooLarge is returned when storing a file larger than the store's whole memory budget. See WithMemoryBudget
+var ErrTooLarge = errors.New("file larger than the store's memory budget")
+
+// Store holds files in memory. Copies of a Store share the same files.
 type Store struct {
-	messages chan<- message
+	shared *shared
 }
 
-type message interface {
-	Filename() string
+type shared struct {
+	cfg config
+	// lock guards st. Readers only hold it long enough to look up an entry, and writers only long enough to update
+	// the maps, so reads carry on in parallel with each other and with the slow parts of a write, such as journaling.
+	lock sync.RWMutex
+	// writeLock serialises changes, so they're applied in the same order they're journaled. While it's held st can
+	// be read without lock, as nothing else can change it.
+	writeLock sync.Mutex
+	st        *state
 }
 
-type putMessage struct {
-	filename string
-	Contents []byte
-}
+// Option customises a Store created by New
+type Option func(*config)
 
-type getMessage struct {
-	filename string
-	reply    chan<- getReply
+type config struct {
+	journal      *Journal
+	snapshotPath string
+	compactSize  int64
+	history      historyLimits
+	compress     bool
+	memoryBudget int64
+	ttls         []ttlRule
 }
 
-type getReply struct {
-	contents []byte
-	prs      bool
+// WithJournal records every change in journal before it is applied. Once the journal grows past compactSize bytes,
+// it's compacted into a snapshot at snapshotPath. A compactSize of zero disables automatic compaction.
+func WithJournal(journal *Journal, snapshotPath string, compactSize int64) Option {
+	return func(cfg *config) {
+		cfg.journal = journal
+		cfg.snapshotPath = snapshotPath
+		cfg.compactSize = compactSize
+	}
 }
 
-func (msg getMessage) Filename() string {
-	return msg.filename
+// WithHistory keeps up to versions older versions of each file, which can be fetched with GetVersion or restored with
+// Rollback. Once the older versions of every file add up to more than maxBytes, the oldest are dropped. A maxBytes of
+// zero means no limit.
+func WithHistory(versions int, maxBytes int64) Option {
+	return func(cfg *config) {
+		cfg.history = historyLimits{versions: versions, bytes: maxBytes}
+	}
 }
 
-func (msg putMessage) Filename() string {
-	return msg.filename
+// WithCompression holds files gzipped in memory when that saves enough space to be worth decompressing them on every
+// read.
+func WithCompression() Option {
+	return func(cfg *config) {
+		cfg.compress = true
+	}
 }
 
-func New() Store {
-	messages := make(chan message)
-	go func() {
-		files := make(map[string][]byte)
-		for {
-			msg := <-messages
-			switch msg.(type) {
-			case getMessage:
-				get := msg.(getMessage)
-				f, prs := files[msg.Filename()]
-				get.reply <- getReply{contents: f, prs: prs}
-			case putMessage:
-				put := msg.(putMessage)
-				files[msg.Filename()] = put.Contents
+func New(opts ...Option) Store {
+	cfg := config{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	s := &shared{cfg: cfg, st: newState(cfg.history)}
+	if len(cfg.ttls) > 0 {
+		go func() {
+			for now := range time.NewTicker(cfg.expiryCheckInterval()).C {
+				s.expireAll(now)
 			}
+		}()
+	}
+	return Store{shared: s}
+}
+
+// lookup finds the given version of filename, or the latest if version is 0. When read is set, the file is marked as
+// read for eviction purposes.
+func (s *shared) lookup(filename string, version int, read bool) (entry, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	latest, prs := s.st.files[filename]
+	// Expired files are left for the next expiry check to remove, so reads never need the write lock
+	if !prs || s.cfg.expired(filename, latest, time.Now()) {
+		return entry{}, false
+	}
+	if read {
+		latest.touch()
+	}
+	if version == 0 {
+		return latest, true
+	}
+	return s.st.version(filename, version)
+}
+
+// commitPut timestamps e, records it in the journal and makes it the latest version of filename, returning its
+// metadata. The caller must hold writeLock.
+func (s *shared) commitPut(filename string, e entry) (Metadata, error) {
+	if s.cfg.tooLarge(e.meta.Size) {
+		return Metadata{}, ErrTooLarge
+	}
+	now := time.Now()
+	e.meta.Created = now
+	e.meta.Modified = now
+	if previous, prs := s.st.files[filename]; prs {
+		e.meta.Created = previous.meta.Created
+	}
+	var seq uint64
+	if s.cfg.journal != nil {
+		var err error
+		if seq, err = s.cfg.journal.appendPut(filename, e); err != nil {
+			return Metadata{}, err
+		}
+	}
+	s.lock.Lock()
+	s.st.put(filename, e)
+	s.st.applied(seq)
+	// Read while writeLock is still held, so it's this put's metadata even if another follows straight after
+	meta := s.st.files[filename].meta
+	s.lock.Unlock()
+	s.evictToBudget(filename)
+	if s.cfg.journal != nil && s.cfg.compactSize > 0 && s.cfg.journal.size >= s.cfg.compactSize {
+		if err := saveSnapshot(s.cfg.snapshotPath, s.st, s.cfg.journal); err != nil {
+			// The put itself is safely in the journal, so this isn't reported to the caller
+			slog.Error("Unable to compact journal", "error", err)
+		}
+	}
+	return meta, nil
+}
+
+// commitDelete records a delete in the journal and removes filename. The caller must hold writeLock.
+func (s *shared) commitDelete(filename string) error {
+	var seq uint64
+	if s.cfg.journal != nil {
+		var err error
+		if seq, err = s.cfg.journal.appendDelete(filename); err != nil {
+			return err
 		}
-	}()
-	return Store{messages: messages}
+	}
+	s.lock.Lock()
+	s.st.delete(filename)
+	s.st.applied(seq)
+	s.lock.Unlock()
+	return nil
+}
+
+// Put stores contents under filename. If the store has a journal, the change is durable once Put returns without
+// error.
+func (store *Store) Put(filename string, contents []byte) error {
+	return store.PutFrom(filename, contents, Origin{})
 }
 
-func (store *Store) Put(filename string, contents []byte) {
-	msg := putMessage{filename: filename, Contents: contents}
-	store.messages <- msg
+// PutFrom stores contents under filename like Put, recording where it came from in the file's metadata.
+func (store *Store) PutFrom(filename string, contents []byte, origin Origin) error {
+	s := store.shared
+	// The checksum and compression are done before taking any locks, so they don't hold up other requests
+	e := s.prepare(newEntry(contents, origin))
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	_, err := s.commitPut(filename, e)
+	return err
 }
 
 func (store *Store) Get(filename string) ([]byte, bool) {
-	reply := make(chan getReply)
-	msg := getMessage{filename: filename, reply: reply}
-	store.messages <- msg
-	r := <-reply
-	return r.contents, r.prs
+	return store.GetVersion(filename, 0)
+}
+
+// Open returns a reader over the contents of filename, along with its metadata. Compressed files are decompressed as
+// they're read.
+func (store *Store) Open(filename string) (io.Reader, Metadata, bool) {
+	return store.OpenVersion(filename, 0)
+}
+
+// OpenVersion is Open for the given version of filename. See WithHistory.
+func (store *Store) OpenVersion(filename string, version int) (io.Reader, Metadata, bool) {
+	e, prs := store.shared.lookup(filename, version, true)
+	if !prs {
+		return nil, Metadata{}, false
+	}
+	return e.open(), e.meta, true
+}
+
+// Stat returns the metadata of filename, and whether it's present.
+func (store *Store) Stat(filename string) (Metadata, bool) {
+	e, prs := store.shared.lookup(filename, 0, false)
+	return e.meta, prs
+}
+
+// GetVersion returns the given version of filename. See WithHistory.
+func (store *Store) GetVersion(filename string, version int) ([]byte, bool) {
+	e, prs := store.shared.lookup(filename, version, true)
+	if !prs {
+		return nil, false
+	}
+	contents, err := e.contents()
+	if err != nil {
+		slog.Error("Unable to decompress", "filename", filename, "error", err)
+		return nil, false
+	}
+	return contents, true
+}
+
+// Versions returns the metadata of every version of filename held, oldest first. The last is the latest version.
+func (store *Store) Versions(filename string) []Metadata {
+	s := store.shared
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.st.versions(filename)
+}
+
+// Rollback makes the contents of an older version of filename the latest version again, returning its metadata.
+// The rollback is stored as a new version, so it can itself be rolled back.
+func (store *Store) Rollback(filename string, version int) (Metadata, error) {
+	s := store.shared
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	old, prs := s.st.version(filename, version)
+	if !prs {
+		return Metadata{}, ErrNotFound
+	}
+	return s.commitPut(filename, old)
+}
+
+// Delete removes filename and all its versions from the store, returning whether it was present.
+func (store *Store) Delete(filename string) (bool, error) {
+	s := store.shared
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if _, prs := s.st.files[filename]; !prs {
+		return false, nil
+	}
+	return true, s.commitDelete(filename)
+}
+
+// Rename moves filename and all its versions to newName, returning the metadata of its latest version. It fails with
+// ErrNotFound if filename isn't present, and with ErrExists if newName is, so a rename never silently replaces another
+// file.
+func (store *Store) Rename(filename string, newName string) (Metadata, error) {
+	s := store.shared
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	latest, prs := s.st.files[filename]
+	if !prs {
+		return Metadata{}, ErrNotFound
+	}
+	if filename == newName {
+		return latest.meta, nil
+	}
+	if _, prs := s.st.files[newName]; prs {
+		return Metadata{}, ErrExists
+	}
+	var seq uint64
+	if s.cfg.journal != nil {
+		var err error
+		if seq, err = s.cfg.journal.appendRename(filename, newName); err != nil {
+			return Metadata{}, err
+		}
+	}
+	s.lock.Lock()
+	s.st.rename(filename, newName)
+	s.st.applied(seq)
+	s.lock.Unlock()
+	return latest.meta, nil
+}
+
+// FileInfo describes a file returned by List
+type FileInfo struct {
+	Name string `json:"name"`
+	Metadata
+}
+
+// ListOptions selects the files returned by List
+type ListOptions struct {
+	// Prefix restricts the listing to filenames starting with it
+	Prefix string
+	// After continues a listing from the first filename after it, as returned by a previous call
+	After string
+	// Limit is the most files returned. Zero means no limit
+	Limit int
+}
+
+// List returns the files matching opts, sorted by name. When there are more files to come, the name to pass as
+// ListOptions.After for the next page is returned too, otherwise it's empty.
+func (store *Store) List(opts ListOptions) ([]FileInfo, string) {
+	s := store.shared
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	now := time.Now()
+	var files []FileInfo
+	for _, filename := range s.st.names(opts.Prefix) {
+		if opts.After != "" && filename <= opts.After {
+			continue
+		}
+		e := s.st.files[filename]
+		if s.cfg.expired(filename, e, now) {
+			continue
+		}
+		if opts.Limit > 0 && len(files) == opts.Limit {
+			return files, files[len(files)-1].Name
+		}
+		files = append(files, FileInfo{Name: filename, Metadata: e.meta})
+	}
+	return files, ""
+}
+
+// Stats summarises the contents of the store.
+func (store *Store) Stats() Stats {
+	s := store.shared
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.st.stats()
+}
+
+// dump returns a point in time copy of everything in the store.
+func (store *Store) dump() *state {
+	s := store.shared
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.st.copy()
+}
+
+// replace swaps the entire contents of the store for contents.
+func (store *Store) replace(contents *state) {
+	s := store.shared
+	s.prepareAll(contents)
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.st.adopt(contents)
 }
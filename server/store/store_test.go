@@ -2,7 +2,11 @@ package store
 
 import (
 	"bytes"
+	"fmt"
+	"io"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestStore_GetEmpty(t *testing.T) {
@@ -34,3 +38,330 @@ func TestStore_PutGetDifferentFile(t *testing.T) {
 		t.Error("File not expected")
 	}
 }
+
+func TestStore_Delete(t *testing.T) {
+	sut := New()
+	sut.Put("test.txt", []byte("test value"))
+
+	prs, err := sut.Delete("test.txt")
+
+	if !prs || err != nil {
+		t.Error("Delete failed", prs, err)
+	}
+	if _, prs := sut.Get("test.txt"); prs {
+		t.Error("File not expected")
+	}
+}
+
+func TestStore_DeleteMissing(t *testing.T) {
+	sut := New()
+
+	prs, err := sut.Delete("test.txt")
+
+	if prs || err != nil {
+		t.Error("Delete of missing file should report not present", prs, err)
+	}
+}
+
+func TestStore_Stat(t *testing.T) {
+	sut := New()
+	sut.PutFrom("test.txt", []byte("test value"), Origin{Uploader: "127.0.0.1:1234", Mode: "octet"})
+
+	meta, prs := sut.Stat("test.txt")
+
+	if !prs {
+		t.Fatal("Expected metadata")
+	}
+	if meta.Size != 10 || meta.Uploader != "127.0.0.1:1234" || meta.Mode != "octet" {
+		t.Error("Metadata incorrect", meta)
+	}
+	if meta.SHA256 != "47d1d8273710fd6f6a5995fac1a0983fe0e8828c288e35e80450ddc5c4412def" {
+		t.Error("Checksum incorrect", meta.SHA256)
+	}
+	if meta.Created.IsZero() || !meta.Created.Equal(meta.Modified) {
+		t.Error("Timestamps incorrect", meta.Created, meta.Modified)
+	}
+}
+
+func TestStore_StatKeepsCreatedOnReplace(t *testing.T) {
+	sut := New()
+	sut.Put("test.txt", []byte("first"))
+	first, _ := sut.Stat("test.txt")
+	time.Sleep(time.Millisecond)
+
+	sut.Put("test.txt", []byte("second"))
+	second, _ := sut.Stat("test.txt")
+
+	if !second.Created.Equal(first.Created) {
+		t.Error("Created time changed", first.Created, second.Created)
+	}
+	if !second.Modified.After(first.Modified) {
+		t.Error("Modified time not updated", first.Modified, second.Modified)
+	}
+}
+
+func TestStore_StatMissing(t *testing.T) {
+	sut := New()
+	if _, prs := sut.Stat("test.txt"); prs {
+		t.Error("Metadata not expected")
+	}
+}
+
+func TestStore_History(t *testing.T) {
+	sut := New(WithHistory(2, 0))
+	sut.Put("test.txt", []byte("first"))
+	sut.Put("test.txt", []byte("second"))
+	sut.Put("test.txt", []byte("third"))
+	sut.Put("test.txt", []byte("fourth"))
+
+	assertContents(t, &sut, "test.txt", []byte("fourth"))
+	versions := sut.Versions("test.txt")
+	if len(versions) != 3 || versions[0].Version != 2 || versions[2].Version != 4 {
+		t.Error("Versions incorrect", versions)
+	}
+	if contents, prs := sut.GetVersion("test.txt", 2); !prs || !bytes.Equal(contents, []byte("second")) {
+		t.Error("Version 2 incorrect", contents, prs)
+	}
+	if _, prs := sut.GetVersion("test.txt", 1); prs {
+		t.Error("Version 1 should have been dropped")
+	}
+}
+
+func TestStore_HistoryByteLimit(t *testing.T) {
+	sut := New(WithHistory(10, 10))
+	sut.Put("a.txt", []byte("12345"))
+	sut.Put("b.txt", []byte("12345"))
+	sut.Put("a.txt", []byte("a2"))
+	sut.Put("b.txt", []byte("b2"))
+	sut.Put("a.txt", []byte("a3"))
+
+	if _, prs := sut.GetVersion("a.txt", 1); prs {
+		t.Error("Oldest version should have been dropped")
+	}
+	if _, prs := sut.GetVersion("b.txt", 1); !prs {
+		t.Error("Version within the limit dropped")
+	}
+}
+
+func TestStore_Rollback(t *testing.T) {
+	sut := New(WithHistory(5, 0))
+	sut.PutFrom("test.txt", []byte("good"), Origin{Uploader: "127.0.0.1:1234"})
+	sut.Put("test.txt", []byte("bad"))
+
+	meta, err := sut.Rollback("test.txt", 1)
+
+	if err != nil {
+		t.Fatal("Rollback failed", err)
+	}
+	if meta.Version != 3 || meta.Uploader != "127.0.0.1:1234" {
+		t.Error("Rollback metadata incorrect", meta)
+	}
+	assertContents(t, &sut, "test.txt", []byte("good"))
+	if _, err := sut.Rollback("test.txt", 7); err != ErrNotFound {
+		t.Error("Expected rollback to missing version to fail", err)
+	}
+}
+
+func TestStore_WithoutHistory(t *testing.T) {
+	sut := New()
+	sut.Put("test.txt", []byte("first"))
+	sut.Put("test.txt", []byte("second"))
+
+	if versions := sut.Versions("test.txt"); len(versions) != 1 || versions[0].Version != 2 {
+		t.Error("Only the latest version should be held", versions)
+	}
+}
+
+func TestStore_StatsSharesIdenticalContents(t *testing.T) {
+	sut := New(WithHistory(5, 0))
+	sut.Put("a.img", []byte("1234567890"))
+	sut.Put("b.img", []byte("1234567890"))
+	sut.Put("c.img", []byte("abcde"))
+
+	stats := sut.Stats()
+
+	if stats.Files != 3 || stats.Versions != 3 || stats.LogicalBytes != 25 || stats.PhysicalBytes != 15 {
+		t.Error("Stats incorrect", stats)
+	}
+}
+
+func TestStore_StatsReleasesContents(t *testing.T) {
+	sut := New()
+	sut.Put("a.img", []byte("1234567890"))
+	sut.Put("b.img", []byte("1234567890"))
+	sut.Put("a.img", []byte("abcde"))
+	sut.Delete("b.img")
+
+	stats := sut.Stats()
+
+	if stats.Files != 1 || stats.LogicalBytes != 5 || stats.PhysicalBytes != 5 {
+		t.Error("Stats incorrect", stats)
+	}
+}
+
+func TestStore_ConcurrentReadsAndWrites(t *testing.T) {
+	sut := New(WithHistory(2, 0))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				sut.Put(fmt.Sprintf("%d.img", i), []byte(fmt.Sprintf("value %d", j)))
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				sut.Get(fmt.Sprintf("%d.img", i))
+				sut.Versions(fmt.Sprintf("%d.img", i))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 4; i++ {
+		assertContents(t, &sut, fmt.Sprintf("%d.img", i), []byte("value 99"))
+	}
+}
+
+// The benchmarks below read a boot image in parallel, as a PXE boot storm would. Run them with -cpu 1,2,4,8 to see
+// how reads scale across cores.
+
+const benchmarkFiles = 16
+
+func newBenchmarkStore() Store {
+	sut := New()
+	contents := bytes.Repeat([]byte("x"), 64*1024)
+	for i := 0; i < benchmarkFiles; i++ {
+		sut.Put(fmt.Sprintf("%d.img", i), contents)
+	}
+	return sut
+}
+
+func BenchmarkStore_ParallelGet(b *testing.B) {
+	sut := newBenchmarkStore()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if _, prs := sut.Get(fmt.Sprintf("%d.img", i%benchmarkFiles)); !prs {
+				b.Fatal("File missing")
+			}
+		}
+	})
+}
+
+func BenchmarkStore_ParallelOpen(b *testing.B) {
+	sut := newBenchmarkStore()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			r, _, prs := sut.Open(fmt.Sprintf("%d.img", i%benchmarkFiles))
+			if !prs {
+				b.Fatal("File missing")
+			}
+			io.Copy(io.Discard, r)
+		}
+	})
+}
+
+func BenchmarkStore_ParallelGetWithPuts(b *testing.B) {
+	sut := newBenchmarkStore()
+	done := make(chan bool)
+	go func() {
+		contents := bytes.Repeat([]byte("y"), 64*1024)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				sut.Put(fmt.Sprintf("%d.img", i%benchmarkFiles), contents)
+			}
+		}
+	}()
+	defer close(done)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if _, prs := sut.Get(fmt.Sprintf("%d.img", i%benchmarkFiles)); !prs {
+				b.Fatal("File missing")
+			}
+		}
+	})
+}
+
+func TestStore_Rename(t *testing.T) {
+	sut := New(WithHistory(5, 0))
+	sut.Put("old.txt", []byte("first"))
+	sut.Put("old.txt", []byte("second"))
+
+	meta, err := sut.Rename("old.txt", "new.txt")
+	if err != nil {
+		t.Fatal("Rename failed", err)
+	}
+	if meta.Version != 2 {
+		t.Error("Expected the latest version's metadata", meta)
+	}
+
+	if _, prs := sut.Get("old.txt"); prs {
+		t.Error("Old name still present")
+	}
+	assertContents(t, &sut, "new.txt", []byte("second"))
+	if versions := sut.Versions("new.txt"); len(versions) != 2 {
+		t.Error("History not renamed", versions)
+	}
+}
+
+func TestStore_RenameFailures(t *testing.T) {
+	sut := New()
+	sut.Put("a.txt", []byte("a"))
+	sut.Put("b.txt", []byte("b"))
+
+	if _, err := sut.Rename("missing.txt", "c.txt"); err != ErrNotFound {
+		t.Error("Expected ErrNotFound", err)
+	}
+	stats := sut.Stats()
+	if _, err := sut.Rename("a.txt", "b.txt"); err != ErrExists {
+		t.Error("Expected ErrExists", err)
+	}
+	assertContents(t, &sut, "b.txt", []byte("b"))
+	if after := sut.Stats(); after != stats {
+		t.Error("Stats changed by a failed rename", stats, after)
+	}
+}
+
+func TestState_RenameReleasesReplacedFile(t *testing.T) {
+	st := newState(historyLimits{versions: 5})
+	st.put("a.txt", newEntry([]byte("a"), Origin{}))
+	st.put("b.txt", newEntry([]byte("bb"), Origin{}))
+	st.put("b.txt", newEntry([]byte("bbb"), Origin{}))
+
+	st.rename("a.txt", "b.txt")
+	st.delete("b.txt")
+
+	if stats := st.stats(); stats != (Stats{CompressionRatio: 1}) || st.historyBytes != 0 {
+		t.Error("Expected nothing left held", stats, st.historyBytes)
+	}
+}
+
+func TestStore_List(t *testing.T) {
+	sut := New()
+	for _, name := range []string{"pxe/b.img", "cfg/a.cfg", "pxe/a.img", "pxe/c.img"} {
+		sut.Put(name, []byte(name))
+	}
+
+	page, next := sut.List(ListOptions{Prefix: "pxe/", Limit: 2})
+	if len(page) != 2 || page[0].Name != "pxe/a.img" || page[1].Name != "pxe/b.img" || next != "pxe/b.img" {
+		t.Fatal("First page incorrect", page, next)
+	}
+	page, next = sut.List(ListOptions{Prefix: "pxe/", After: next, Limit: 2})
+	if len(page) != 1 || page[0].Name != "pxe/c.img" || next != "" {
+		t.Error("Second page incorrect", page, next)
+	}
+	if page[0].Size != int64(len("pxe/c.img")) {
+		t.Error("Metadata not listed", page[0])
+	}
+	if all, _ := sut.List(ListOptions{}); len(all) != 4 {
+		t.Error("Expected every file", all)
+	}
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"hash"
+)
+
+// ErrUploadClosed is returned when writing to an Upload that has already been committed or aborted
+var ErrUploadClosed = errors.New("upload already committed or aborted")
+
+// Upload receives the contents of a file as they arrive. Nothing is visible in the store until Commit is called, and
+// Abort discards everything written so far.
+type Upload struct {
+	store    *Store
+	filename string
+	origin   Origin
+	buff     *bytes.Buffer
+	// digest is calculated as the contents arrive, so it doesn't hold up Commit
+	digest hash.Hash
+	closed bool
+}
+
+// PutWriter starts an upload that stores filename once committed, recording origin in its metadata like PutFrom.
+func (store *Store) PutWriter(filename string, origin Origin) *Upload {
+	return &Upload{store: store, filename: filename, origin: origin, buff: new(bytes.Buffer), digest: sha256.New()}
+}
+
+// Write adds p to the contents. It fails with ErrTooLarge as soon as the contents grow larger than the store's memory
+// budget, so an upload that can't be kept isn't buffered any further.
+func (upload *Upload) Write(p []byte) (int, error) {
+	if upload.closed {
+		return 0, ErrUploadClosed
+	}
+	if upload.store.shared.cfg.tooLarge(int64(upload.buff.Len() + len(p))) {
+		return 0, ErrTooLarge
+	}
+	upload.digest.Write(p)
+	return upload.buff.Write(p)
+}
+
+// Commit stores everything written as the latest version of the file, returning its metadata. If the store has a
+// journal, the change is durable once Commit returns without error. The upload is closed whether or not Commit
+// succeeds.
+func (upload *Upload) Commit() (Metadata, error) {
+	if upload.closed {
+		return Metadata{}, ErrUploadClosed
+	}
+	upload.closed = true
+	contents := upload.buff.Bytes()
+	if cap(contents) > len(contents) {
+		// The buffer grows by doubling, so keeping its backing array could hold on to nearly twice the file's size
+		contents = append(make([]byte, 0, len(contents)), contents...)
+	}
+	upload.buff = nil
+	s := upload.store.shared
+	e := s.prepare(entryWithDigest(contents, upload.digest.Sum(nil), upload.origin))
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.commitPut(upload.filename, e)
+}
+
+// Abort discards everything written. It does nothing once the upload has been committed, so it's safe to defer.
+func (upload *Upload) Abort() {
+	upload.closed = true
+	upload.buff = nil
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"testing"
+)
+
+func TestUpload_Commit(t *testing.T) {
+	sut := New()
+	upload := sut.PutWriter("test.txt", Origin{Uploader: "127.0.0.1:1234", Mode: "octet"})
+	upload.Write([]byte("test "))
+	upload.Write([]byte("value"))
+
+	if _, prs := sut.Get("test.txt"); prs {
+		t.Error("File visible before commit")
+	}
+	meta, err := upload.Commit()
+	if err != nil {
+		t.Fatal("Commit failed", err)
+	}
+
+	assertContents(t, &sut, "test.txt", []byte("test value"))
+	if stat, _ := sut.Stat("test.txt"); stat != meta {
+		t.Error("Commit returned different metadata to Stat", meta, stat)
+	}
+	if meta.SHA256 != newEntry([]byte("test value"), Origin{}).meta.SHA256 || meta.Uploader != "127.0.0.1:1234" {
+		t.Error("Metadata incorrect", meta)
+	}
+}
+
+func TestUpload_CommitTrimsBuffer(t *testing.T) {
+	sut := New()
+	upload := sut.PutWriter("test.txt", Origin{})
+	for i := 0; i < 100; i++ {
+		upload.Write([]byte("0123456789"))
+	}
+	if _, err := upload.Commit(); err != nil {
+		t.Fatal("Commit failed", err)
+	}
+
+	if data := sut.shared.st.files["test.txt"].data; cap(data) != len(data) {
+		t.Error("Stored contents kept the upload's spare capacity", len(data), cap(data))
+	}
+}
+
+func TestUpload_Abort(t *testing.T) {
+	sut := New()
+	sut.Put("test.txt", []byte("first"))
+	upload := sut.PutWriter("test.txt", Origin{})
+	upload.Write([]byte("partial"))
+
+	upload.Abort()
+
+	assertContents(t, &sut, "test.txt", []byte("first"))
+	if _, err := upload.Write([]byte("more")); err != ErrUploadClosed {
+		t.Error("Expected write after abort to fail", err)
+	}
+	if _, err := upload.Commit(); err != ErrUploadClosed {
+		t.Error("Expected commit after abort to fail", err)
+	}
+}
+
+func TestUpload_AbortAfterCommit(t *testing.T) {
+	sut := New()
+	upload := sut.PutWriter("test.txt", Origin{})
+	upload.Write([]byte("test value"))
+	upload.Commit()
+
+	upload.Abort()
+
+	assertContents(t, &sut, "test.txt", []byte("test value"))
+}
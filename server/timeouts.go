@@ -0,0 +1,26 @@
+package server
+
+import (
+	"time"
+)
+
+// Timeouts controls how long a transfer waits on the client, and how often it retries, before giving up
+type Timeouts struct {
+	// Block is how long to keep trying to send or receive a block before abandoning the transfer
+	Block time.Duration
+	// Ack is how long to wait for a block to be acknowledged before sending it again
+	Ack time.Duration
+	// Data is how long to wait for the next block of an upload before acknowledging the last one again
+	Data time.Duration
+	// Retries limits how many times a block or acknowledgement is sent again before abandoning the transfer. 0 keeps
+	// retrying until Block runs out
+	Retries int
+}
+
+// DefaultTimeouts are the timeouts used unless WithTimeouts is given
+var DefaultTimeouts = Timeouts{Block: 30 * time.Second, Ack: 10 * time.Second, Data: 2 * time.Second}
+
+// retriesExhausted returns whether retries have been made, given the limit in timeouts
+func (timeouts Timeouts) retriesExhausted(retries int) bool {
+	return timeouts.Retries > 0 && retries > timeouts.Retries
+}
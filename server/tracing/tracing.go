@@ -0,0 +1,283 @@
+// Package tracing records spans and exports them in batches, either as JSON lines or to an OpenTelemetry collector
+// over OTLP/HTTP.
+//
+// A nil *Tracer or *Span is valid and records nothing, so code being traced needn't check whether tracing is enabled.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// batchSize is the most spans exported at once
+	batchSize = 512
+	// queueSize is the most spans held waiting to be exported. Once full, further spans are dropped
+	queueSize = 4096
+)
+
+// Exporter sends finished spans somewhere
+type Exporter interface {
+	Export(ctx context.Context, resource []Attribute, spans []SpanData) error
+}
+
+// Tracer starts spans and exports them once they end
+type Tracer struct {
+	exporter Exporter
+	resource []Attribute
+	interval time.Duration
+	queue    chan SpanData
+	// flushed is closed once the queue has been drained on shutdown
+	flushed chan struct{}
+	// lock guards stopped, so nothing is queued once the queue is closed
+	lock    sync.RWMutex
+	stopped bool
+}
+
+// Option customises a Tracer created by New
+type Option func(*Tracer)
+
+// WithResource describes what's being traced, e.g. its service.name, on every span exported.
+func WithResource(attrs ...Attribute) Option {
+	return func(t *Tracer) {
+		t.resource = append(t.resource, attrs...)
+	}
+}
+
+// WithInterval exports the spans ended at least this often. Defaults to 5s.
+func WithInterval(interval time.Duration) Option {
+	return func(t *Tracer) {
+		t.interval = interval
+	}
+}
+
+// New starts exporting spans to exporter. Shutdown must be called to export the last of them.
+func New(exporter Exporter, opts ...Option) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		interval: 5 * time.Second,
+		queue:    make(chan SpanData, queueSize),
+		flushed:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	go t.export()
+	return t
+}
+
+// Start starts a span. If parent is nil, it's the root of a new trace.
+func (t *Tracer) Start(name string, parent *Span, attrs ...Attribute) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, data: SpanData{Name: name, Kind: KindInternal, Start: time.Now(), Attributes: attrs}}
+	if parent != nil {
+		s.data.TraceID = parent.data.TraceID
+		s.data.ParentSpanID = parent.data.SpanID
+	} else {
+		s.data.Kind = KindServer
+		rand.Read(s.data.TraceID[:])
+	}
+	rand.Read(s.data.SpanID[:])
+	return s
+}
+
+func (t *Tracer) finished(data SpanData) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if t.stopped {
+		return
+	}
+	select {
+	case t.queue <- data:
+	default:
+		slog.Warn("Trace queue full, dropping span", "span", data.Name)
+	}
+}
+
+func (t *Tracer) export() {
+	defer close(t.flushed)
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	var batch []SpanData
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := t.exporter.Export(ctx, t.resource, batch); err != nil {
+			slog.Error("Unable to export spans", "spans", len(batch), "error", err)
+		}
+		cancel()
+		batch = nil
+	}
+	for {
+		select {
+		case data, ok := <-t.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, data)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Shutdown exports the spans that have ended, waiting until they're exported or ctx is done. Spans ending after
+// Shutdown is called are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	if !t.stopped {
+		t.stopped = true
+		close(t.queue)
+	}
+	t.lock.Unlock()
+	select {
+	case <-t.flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SpanKind says what role a span plays, as in OpenTelemetry
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+)
+
+// StatusCode is the outcome of a span, as in OpenTelemetry
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// SpanData is a finished span, as passed to an Exporter
+type SpanData struct {
+	TraceID       [16]byte
+	SpanID        [8]byte
+	ParentSpanID  [8]byte
+	Name          string
+	Kind          SpanKind
+	Start         time.Time
+	End           time.Time
+	Attributes    []Attribute
+	Events        []Event
+	Status        StatusCode
+	StatusMessage string
+}
+
+// Event is something that happened at a point in a span
+type Event struct {
+	Name       string
+	Time       time.Time
+	Attributes []Attribute
+}
+
+// Span is an operation being traced
+type Span struct {
+	tracer *Tracer
+	lock   sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// SetAttributes adds attributes to the span, replacing any with the same keys
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, attr := range attrs {
+		replaced := false
+		for i := range s.data.Attributes {
+			if s.data.Attributes[i].Key == attr.Key {
+				s.data.Attributes[i] = attr
+				replaced = true
+			}
+		}
+		if !replaced {
+			s.data.Attributes = append(s.data.Attributes, attr)
+		}
+	}
+}
+
+// AddEvent records that something happened now
+func (s *Span) AddEvent(name string, attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Events = append(s.data.Events, Event{Name: name, Time: time.Now(), Attributes: attrs})
+}
+
+// SetStatus sets the outcome of the span. The message is only kept for StatusError
+func (s *Span) SetStatus(code StatusCode, message string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Status = code
+	if code == StatusError {
+		s.data.StatusMessage = message
+	}
+}
+
+// End finishes the span and queues it to be exported. Only the first call has any effect
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.lock.Unlock()
+	s.tracer.finished(data)
+}
+
+// Attribute is a key and a string, int64, float64 or bool value
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+func String(key string, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Int(key string, value int64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Float(key string, value float64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
@@ -0,0 +1,145 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type recorder struct {
+	lock     sync.Mutex
+	resource []Attribute
+	spans    []SpanData
+}
+
+func (r *recorder) Export(ctx context.Context, resource []Attribute, spans []SpanData) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.resource = resource
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func TestTracer_Spans(t *testing.T) {
+	r := &recorder{}
+	sut := New(r, WithResource(String("service.name", "test")))
+
+	root := sut.Start("request", nil, String("filename", "a.txt"))
+	child := sut.Start("data", root)
+	child.AddEvent("retransmit", Int("block", 3))
+	child.End()
+	root.SetAttributes(Int("bytes", 10), String("filename", "b.txt"))
+	root.SetStatus(StatusError, "failed")
+	root.End()
+	root.End()
+	sut.Shutdown(context.Background())
+
+	if len(r.spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(r.spans))
+	}
+	data, request := r.spans[0], r.spans[1]
+	if data.TraceID != request.TraceID || data.ParentSpanID != request.SpanID || request.ParentSpanID != ([8]byte{}) {
+		t.Errorf("Expected data to be a child of request: %+v %+v", data, request)
+	}
+	if request.Kind != KindServer || data.Kind != KindInternal {
+		t.Errorf("Unexpected kinds %d %d", request.Kind, data.Kind)
+	}
+	if len(data.Events) != 1 || data.Events[0].Name != "retransmit" {
+		t.Errorf("Unexpected events %+v", data.Events)
+	}
+	if len(request.Attributes) != 2 || request.Attributes[0].Value != "b.txt" || request.Attributes[1].Value != int64(10) {
+		t.Errorf("Unexpected attributes %+v", request.Attributes)
+	}
+	if request.Status != StatusError || request.StatusMessage != "failed" {
+		t.Errorf("Unexpected status %d %q", request.Status, request.StatusMessage)
+	}
+	if len(r.resource) != 1 || r.resource[0].Key != "service.name" {
+		t.Errorf("Unexpected resource %+v", r.resource)
+	}
+}
+
+func TestTracer_Nil(t *testing.T) {
+	var sut *Tracer
+	span := sut.Start("request", nil)
+	span.SetAttributes(String("a", "b"))
+	span.AddEvent("event")
+	span.SetStatus(StatusOK, "")
+	span.End()
+	if err := sut.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriterExporter(t *testing.T) {
+	var out bytes.Buffer
+	sut := New(NewWriterExporter(&out))
+	root := sut.Start("request", nil, String("filename", "a.txt"))
+	sut.Start("data", root).End()
+	root.End()
+	sut.Shutdown(context.Background())
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got:\n%s", out.String())
+	}
+	var data, request spanLine
+	json.Unmarshal([]byte(lines[0]), &data)
+	json.Unmarshal([]byte(lines[1]), &request)
+	if data.Name != "data" || data.ParentSpanID != request.SpanID || len(request.TraceID) != 32 ||
+		request.Attributes["filename"] != "a.txt" {
+		t.Errorf("Unexpected spans:\n%s", out.String())
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body []byte
+	var contentType string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		contentType = r.Header.Get("Content-Type")
+	}))
+	defer collector.Close()
+	sut := New(NewOTLPExporter(collector.URL, nil), WithResource(String("service.name", "test")))
+	span := sut.Start("request", nil, Int("bytes", 10), Bool("ok", true))
+	span.AddEvent("retransmit")
+	span.End()
+	sut.Shutdown(context.Background())
+
+	if contentType != "application/json" {
+		t.Errorf("Unexpected content type %q", contentType)
+	}
+	var req struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []map[string]interface{}
+			}
+			ScopeSpans []struct {
+				Spans []map[string]interface{}
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err, string(body))
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span in %s", body)
+	}
+	span0 := spans[0]
+	if span0["name"] != "request" || len(span0["traceId"].(string)) != 32 || len(span0["spanId"].(string)) != 16 ||
+		span0["kind"] != 2.0 {
+		t.Errorf("Unexpected span %v", span0)
+	}
+	if _, isString := span0["startTimeUnixNano"].(string); !isString {
+		t.Errorf("Expected times as strings: %v", span0)
+	}
+	if !strings.Contains(string(body), `{"key":"bytes","value":{"intValue":"10"}}`) {
+		t.Errorf("Expected an int attribute in %s", body)
+	}
+}
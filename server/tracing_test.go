@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"github.com/sblundy/inmemorytftp/server/packets"
+	"github.com/sblundy/inmemorytftp/server/tracing"
+	"net"
+	"sync"
+	"testing"
+)
+
+type spanRecorder struct {
+	lock  sync.Mutex
+	spans []tracing.SpanData
+}
+
+func (r *spanRecorder) Export(ctx context.Context, resource []tracing.Attribute, spans []tracing.SpanData) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func (r *spanRecorder) names() []string {
+	names := make([]string, len(r.spans))
+	for i, s := range r.spans {
+		names[i] = s.Name
+	}
+	return names
+}
+
+func TestTracing_Transfer(t *testing.T) {
+	recorder := &spanRecorder{}
+	tracer := tracing.New(recorder)
+	server := New(0, 0, WithTracer(tracer))
+	req := server.receive(&net.UDPAddr{}, directionRead, "test.txt", "octet")
+	dummyConn := NewDummyPacketConn("TestTracing_Transfer", nil, packets.NewAck(1))
+	sut := server.newTransfer("client", directionRead, "test.txt", "octet")
+	req.negotiation.End()
+	sut.span = req.span
+	sut.begin(&dummyConn)
+
+	sut.end(HandleReadRequest(sut, bytes.NewReader([]byte("test")), DefaultTimeouts, testLogger))
+	tracer.Shutdown(context.Background())
+
+	if names := recorder.names(); len(names) != 3 || names[0] != "tftp.negotiation" || names[1] != "tftp.data" || names[2] != "tftp.read" {
+		t.Fatalf("Unexpected spans %v", names)
+	}
+	data, root := recorder.spans[1], recorder.spans[2]
+	if len(data.Events) != 1 || data.Events[0].Name != "retransmit" {
+		t.Errorf("Expected a retransmit event: %+v", data.Events)
+	}
+	if root.Status != tracing.StatusOK || !hasAttribute(root, "tftp.bytes", int64(4)) || !hasAttribute(root, "tftp.filename", "test.txt") {
+		t.Errorf("Unexpected root span %+v", root)
+	}
+}
+
+func TestTracing_Refused(t *testing.T) {
+	recorder := &spanRecorder{}
+	tracer := tracing.New(recorder)
+	server := New(0, 0, WithTracer(tracer))
+	dummyConn := NewDummyPacketConn("TestTracing_Refused")
+
+	server.onReadRequest(&dummyConn, packets.ReadPacket{Filename: "missing.txt", Mode: "octet"}, &net.UDPAddr{})
+	tracer.Shutdown(context.Background())
+
+	if names := recorder.names(); len(names) != 2 || names[1] != "tftp.read" {
+		t.Fatalf("Unexpected spans %v", names)
+	}
+	if root := recorder.spans[1]; root.Status != tracing.StatusError || root.StatusMessage != "File not found" ||
+		!hasAttribute(root, "tftp.error.code", int64(1)) {
+		t.Errorf("Unexpected root span %+v", root)
+	}
+}
+
+func hasAttribute(span tracing.SpanData, key string, value interface{}) bool {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			return attr.Value == value
+		}
+	}
+	return false
+}
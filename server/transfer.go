@@ -0,0 +1,373 @@
+package server
+
+import (
+	"errors"
+	"github.com/sblundy/inmemorytftp/server/audit"
+	"github.com/sblundy/inmemorytftp/server/connection"
+	"github.com/sblundy/inmemorytftp/server/metrics"
+	"github.com/sblundy/inmemorytftp/server/packets"
+	"github.com/sblundy/inmemorytftp/server/store"
+	"github.com/sblundy/inmemorytftp/server/tracing"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	directionRead  = "read"
+	directionWrite = "write"
+)
+
+// serverMetrics are the metrics a TftpServer keeps. See WithMetrics.
+type serverMetrics struct {
+	requests           *metrics.CounterVec
+	transfersStarted   *metrics.CounterVec
+	transfersCompleted *metrics.CounterVec
+	transfersFailed    *metrics.CounterVec
+	bytesSent          *metrics.Counter
+	bytesReceived      *metrics.Counter
+	retransmissions    *metrics.CounterVec
+	timeouts           *metrics.CounterVec
+	errorsSent         *metrics.CounterVec
+	activeSessions     *metrics.Gauge
+	duration           *metrics.HistogramVec
+}
+
+func newServerMetrics(reg *metrics.Registry, st store.Store) *serverMetrics {
+	m := &serverMetrics{
+		requests:           reg.Counter("tftp_requests_total", "Packets received on the server port, by opcode.", "opcode"),
+		transfersStarted:   reg.Counter("tftp_transfers_started_total", "Transfers started, by direction.", "direction"),
+		transfersCompleted: reg.Counter("tftp_transfers_completed_total", "Transfers completed successfully, by direction.", "direction"),
+		transfersFailed:    reg.Counter("tftp_transfers_failed_total", "Transfers that failed, by direction.", "direction"),
+		bytesSent:          reg.Counter("tftp_bytes_sent_total", "File bytes sent in DATA packets, including retransmissions.").With(),
+		bytesReceived:      reg.Counter("tftp_bytes_received_total", "File bytes received in DATA packets, including duplicates.").With(),
+		retransmissions:    reg.Counter("tftp_retransmissions_total", "DATA or ACK packets sent again, by transfer direction.", "direction"),
+		timeouts:           reg.Counter("tftp_timeouts_total", "Waits for a packet from the client that timed out, by transfer direction.", "direction"),
+		errorsSent:         reg.Counter("tftp_error_packets_sent_total", "ERROR packets sent, by error code.", "code"),
+		activeSessions:     reg.Gauge("tftp_active_sessions", "Transfers in progress.").With(),
+		duration: reg.Histogram("tftp_transfer_duration_seconds", "How long transfers took, by direction and outcome.",
+			[]float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300}, "direction", "outcome"),
+	}
+	reg.GaugeFunc("tftp_store_files", "Files in the store, not counting older versions.", func() float64 {
+		return float64(st.Stats().Files)
+	})
+	reg.GaugeFunc("tftp_store_versions", "Versions held in the store, including the latest of each file.", func() float64 {
+		return float64(st.Stats().Versions)
+	})
+	reg.GaugeFunc("tftp_store_logical_bytes", "Total size of every version held in the store.", func() float64 {
+		return float64(st.Stats().LogicalBytes)
+	})
+	reg.GaugeFunc("tftp_store_physical_bytes", "Memory used to hold the store's contents.", func() float64 {
+		return float64(st.Stats().PhysicalBytes)
+	})
+	return m
+}
+
+// reply counts the ERROR packets sent on the server port
+type reply struct {
+	connection.TftpReplyChannel
+	metrics *serverMetrics
+}
+
+func (r reply) Write(packet packets.Packet) bool {
+	if errPacket, ok := packet.(packets.ErrorPacket); ok {
+		r.metrics.errorsSent.With(strconv.Itoa(int(errPacket.ErrorCode))).Inc()
+	}
+	return r.TftpReplyChannel.Write(packet)
+}
+
+// transfer follows a single transfer as its packets pass through the connection, counting them in the metrics and
+// auditing it once it ends
+type transfer struct {
+	connection.TftpPacketConn
+	server *TftpServer
+	// logger carries the session id, client, filename and direction of the transfer
+	logger    *slog.Logger
+	session   uint64
+	client    string
+	direction string
+	filename  string
+	mode      string
+	// version and sha256 identify the version of the file being sent, for a read
+	version int
+	sha256  string
+	start   time.Time
+	// lastSent is the last DATA or ACK packet sent, to spot retransmissions
+	lastSent packets.Packet
+	// lastReceived is the block number of the last DATA packet received, to spot duplicates
+	lastReceived uint16
+	// progress guards block, bytes and retransmits, which are read by Transfers while the transfer runs
+	progress sync.Mutex
+	// block is the last block sent, for a read, or received, for a write
+	block uint16
+	// bytes counts the file bytes transferred, not including retransmissions or duplicates
+	bytes       int64
+	retransmits int
+	// errPacket is the ERROR packet that ended the transfer, whichever side sent it
+	errPacket *packets.ErrorPacket
+	// span covers the whole request, and dataSpan the transfer once it's started. Both are nil if it isn't traced
+	span     *tracing.Span
+	dataSpan *tracing.Span
+	// cancelled is closed once the transfer is cancelled. See cancel
+	cancelled  chan struct{}
+	cancelOnce sync.Once
+}
+
+func (server *TftpServer) newTransfer(client string, direction string, filename string, mode string) *transfer {
+	session := atomic.AddUint64(server.sessions, 1)
+	return &transfer{
+		server:    server,
+		logger:    server.logger.With("session", session, "client", client, "filename", filename, "direction", direction),
+		session:   session,
+		client:    client,
+		direction: direction,
+		filename:  filename,
+		mode:      mode,
+		cancelled: make(chan struct{}),
+	}
+}
+
+// request is a read or write request, followed from when it's received until it's refused or its transfer starts
+type request struct {
+	client    net.Addr
+	direction string
+	filename  string
+	mode      string
+	// settings are those in use when the request was received, so a Reconfigure doesn't change them part way through
+	settings Settings
+	// span covers the whole request, and negotiation the time until it's refused or its transfer starts
+	span        *tracing.Span
+	negotiation *tracing.Span
+	// version and sha256 identify the version of the file found for a read, so they're known when its transfer starts
+	version int
+	sha256  string
+}
+
+func (server *TftpServer) receive(client net.Addr, direction string, filename string, mode string) *request {
+	server.emit(Event{Type: EventRequestReceived, Client: client.String(), Direction: direction, Filename: filename, Mode: mode})
+	span := server.tracer.Start("tftp."+direction, nil,
+		tracing.String("tftp.direction", direction),
+		tracing.String("tftp.filename", filename),
+		tracing.String("tftp.mode", mode),
+		tracing.String("client.address", client.String()))
+	return &request{
+		client:      client,
+		direction:   direction,
+		filename:    filename,
+		mode:        mode,
+		settings:    server.Settings(),
+		span:        span,
+		negotiation: server.tracer.Start("tftp.negotiation", span),
+	}
+}
+
+// errBusy is returned by startTransfer when the limit set by WithMaxSessions has been reached
+var errBusy = errors.New("too many transfers in progress")
+
+// startTransfer opens a connection from a new local port to the client, as each transfer has its own
+func (server *TftpServer) startTransfer(req *request) (*transfer, error) {
+	if !server.active.reserve(req.settings.MaxSessions) {
+		return nil, errBusy
+	}
+	// The reservation is only needed until begin adds the transfer to those in progress
+	defer server.active.unreserve()
+	t := server.newTransfer(req.client.String(), req.direction, req.filename, req.mode)
+	t.version, t.sha256 = req.version, req.sha256
+	conn, err := connection.New(req.client, t.logger)
+	if err != nil {
+		t.logger.Error("Unable to open a local port", "error", err)
+		return nil, err
+	}
+	req.negotiation.End()
+	t.span = req.span
+	t.begin(conn)
+	return t, nil
+}
+
+// begin starts following the transfer over conn
+func (t *transfer) begin(conn connection.TftpPacketConn) {
+	t.TftpPacketConn = conn
+	t.start = time.Now()
+	t.server.metrics.transfersStarted.With(t.direction).Inc()
+	t.server.metrics.activeSessions.Inc()
+	t.server.active.add(t)
+	if t.span != nil {
+		t.span.SetAttributes(tracing.Int("tftp.session", int64(t.session)))
+		t.dataSpan = t.server.tracer.Start("tftp.data", t.span)
+	}
+	t.server.emit(t.event(EventTransferStarted))
+}
+
+// end records the outcome of the transfer
+func (t *transfer) end(ok bool) {
+	t.server.active.remove(t)
+	m := t.server.metrics
+	m.activeSessions.Dec()
+	outcome := audit.OutcomeCompleted
+	if ok {
+		m.transfersCompleted.With(t.direction).Inc()
+	} else {
+		outcome = audit.OutcomeFailed
+		m.transfersFailed.With(t.direction).Inc()
+	}
+	duration := time.Since(t.start)
+	m.duration.With(t.direction, outcome).Observe(duration.Seconds())
+
+	record := audit.Record{
+		Time:        time.Now(),
+		Session:     t.session,
+		Client:      t.client,
+		Direction:   t.direction,
+		Filename:    t.filename,
+		Mode:        t.mode,
+		Bytes:       t.bytes,
+		Duration:    duration.Seconds(),
+		Retransmits: t.retransmits,
+		Outcome:     outcome,
+	}
+	if !ok && t.errPacket != nil {
+		record.ErrorCode = &t.errPacket.ErrorCode
+		record.Error = t.errPacket.Message
+	}
+	t.server.audit(record)
+
+	event := t.event(EventTransferCompleted)
+	if !ok {
+		event.Type = EventTransferFailed
+		event.ErrorCode = record.ErrorCode
+		event.Error = record.Error
+	}
+	event.Duration = duration
+	t.server.emit(event)
+
+	t.dataSpan.End()
+	t.span.SetAttributes(
+		tracing.Int("tftp.bytes", t.bytes),
+		tracing.Int("tftp.blocks", int64(t.block)),
+		tracing.Int("tftp.retransmits", int64(t.retransmits)))
+	if ok {
+		t.span.SetStatus(tracing.StatusOK, "")
+	} else {
+		if t.errPacket != nil {
+			t.span.SetAttributes(tracing.Int("tftp.error.code", int64(t.errPacket.ErrorCode)))
+		}
+		t.span.SetStatus(tracing.StatusError, record.Error)
+	}
+	t.span.End()
+}
+
+func (t *transfer) Read(timeout time.Duration) (packets.Packet, bool) {
+	if t.isCancelled() {
+		return t.readCancelled()
+	}
+	packet, ok := t.TftpPacketConn.Read(timeout)
+	if t.isCancelled() {
+		return t.readCancelled()
+	}
+	m := t.server.metrics
+	if !ok {
+		m.timeouts.With(t.direction).Inc()
+		return packet, ok
+	}
+	switch p := packet.(type) {
+	case packets.DataPacket:
+		m.bytesReceived.Add(float64(len(p.Data)))
+		if p.Block == t.lastReceived+1 {
+			t.lastReceived = p.Block
+			t.progress.Lock()
+			t.block = p.Block
+			t.bytes += int64(len(p.Data))
+			t.progress.Unlock()
+			t.server.emit(t.event(EventTransferProgress))
+		}
+	case packets.ErrorPacket:
+		t.errPacket = &p
+		t.dataSpan.AddEvent("error", tracing.String("tftp.error.sender", "client"),
+			tracing.Int("tftp.error.code", int64(p.ErrorCode)), tracing.String("tftp.error.message", p.Message))
+	}
+	return packet, ok
+}
+
+func (t *transfer) Write(packet packets.Packet) bool {
+	if t.isCancelled() {
+		return false
+	}
+	m := t.server.metrics
+	switch p := packet.(type) {
+	case packets.DataPacket:
+		m.bytesSent.Add(float64(len(p.Data)))
+		if last, ok := t.lastSent.(packets.DataPacket); ok && last.Block == p.Block {
+			t.retransmitted(p.Block)
+		} else {
+			t.progress.Lock()
+			t.block = p.Block
+			t.bytes += int64(len(p.Data))
+			t.progress.Unlock()
+			t.server.emit(t.event(EventTransferProgress))
+		}
+		t.lastSent = p
+	case packets.AckPacket:
+		if last, ok := t.lastSent.(packets.AckPacket); ok && last.Block == p.Block {
+			t.retransmitted(p.Block)
+		}
+		t.lastSent = p
+	case packets.ErrorPacket:
+		m.errorsSent.With(strconv.Itoa(int(p.ErrorCode))).Inc()
+		t.errPacket = &p
+		t.dataSpan.AddEvent("error", tracing.String("tftp.error.sender", "server"),
+			tracing.Int("tftp.error.code", int64(p.ErrorCode)), tracing.String("tftp.error.message", p.Message))
+	}
+	return t.TftpPacketConn.Write(packet)
+}
+
+func (t *transfer) retransmitted(block uint16) {
+	t.dataSpan.AddEvent("retransmit", tracing.Int("tftp.block", int64(block)))
+	t.progress.Lock()
+	t.retransmits++
+	t.progress.Unlock()
+	t.server.metrics.retransmissions.With(t.direction).Inc()
+}
+
+// refuse turns a request down with an ERROR packet before any transfer starts, auditing it as a failed transfer
+func (server *TftpServer) refuse(replyChannel connection.TftpReplyChannel, req *request, code uint16, msg string) {
+	replyChannel.Write(packets.NewError(code, msg))
+	server.audit(audit.Record{
+		Time:      time.Now(),
+		Client:    req.client.String(),
+		Direction: req.direction,
+		Filename:  req.filename,
+		Mode:      req.mode,
+		Outcome:   audit.OutcomeFailed,
+		ErrorCode: &code,
+		Error:     msg,
+	})
+	server.emit(Event{Type: EventRequestDenied, Client: req.client.String(), Direction: req.direction,
+		Filename: req.filename, Mode: req.mode, ErrorCode: &code, Error: msg})
+	req.negotiation.End()
+	req.span.SetAttributes(tracing.Int("tftp.error.code", int64(code)))
+	req.span.SetStatus(tracing.StatusError, msg)
+	req.span.End()
+}
+
+// refuseStart refuses a request whose transfer couldn't be started
+func (server *TftpServer) refuseStart(replyChannel connection.TftpReplyChannel, req *request, err error) {
+	if err == errBusy {
+		server.logger.Warn("Refusing request, too many transfers in progress", "client", req.client.String(),
+			"filename", req.filename, "maxSessions", req.settings.MaxSessions)
+		server.refuse(replyChannel, req, 0, "Server busy, try again later")
+		return
+	}
+	server.refuse(replyChannel, req, 0, "Unable to open local port")
+}
+
+func (server *TftpServer) audit(record audit.Record) {
+	if server.auditLog == nil {
+		return
+	}
+	if err := server.auditLog.Write(record); err != nil {
+		server.logger.Error("Unable to write audit record", "error", err)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/sblundy/inmemorytftp/server/audit"
+	"github.com/sblundy/inmemorytftp/server/metrics"
+	"github.com/sblundy/inmemorytftp/server/packets"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransfer_CountsRead(t *testing.T) {
+	reg := metrics.NewRegistry()
+	server := New(0, 0, WithMetrics(reg))
+	dummyConn := NewDummyPacketConn("TestTransfer_CountsRead", nil, packets.NewAck(1))
+	sut := server.newTransfer("client", directionRead, "test.txt", "octet")
+	sut.begin(&dummyConn)
+
+	sut.end(HandleReadRequest(sut, bytes.NewReader([]byte("test")), DefaultTimeouts, testLogger))
+
+	assertMetric(t, reg, `tftp_transfers_completed_total{direction="read"} 1`)
+	assertMetric(t, reg, `tftp_retransmissions_total{direction="read"} 1`)
+	assertMetric(t, reg, `tftp_bytes_sent_total 8`)
+	assertMetric(t, reg, `tftp_active_sessions 0`)
+}
+
+func TestTransfer_CountsFailedWrite(t *testing.T) {
+	reg := metrics.NewRegistry()
+	server := New(0, 0, WithMetrics(reg))
+	dummyConn := NewDummyPacketConn("TestTransfer_CountsFailedWrite",
+		packets.NewData(1, []byte(strings.Repeat("12345678", 64))),
+		packets.NewError(3, "test"))
+	sut := server.newTransfer("client", directionWrite, "test.txt", "octet")
+	sut.begin(&dummyConn)
+
+	sut.end(HandleWriteRequest(sut, &bufferWriter{}, DefaultTimeouts, testLogger))
+
+	assertMetric(t, reg, `tftp_transfers_failed_total{direction="write"} 1`)
+	assertMetric(t, reg, `tftp_bytes_received_total 512`)
+}
+
+func TestTransfer_Audits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := audit.Open(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := New(0, 0, WithAuditLog(auditLog))
+
+	readConn := NewDummyPacketConn("TestTransfer_Audits", nil, packets.NewAck(1))
+	read := server.newTransfer("client", directionRead, "test.txt", "octet")
+	read.begin(&readConn)
+	read.end(HandleReadRequest(read, bytes.NewReader([]byte("test")), DefaultTimeouts, testLogger))
+
+	writeConn := NewDummyPacketConn("TestTransfer_Audits",
+		packets.NewData(1, []byte(strings.Repeat("12345678", 64))),
+		packets.NewError(3, "test"))
+	write := server.newTransfer("client", directionWrite, "test.txt", "octet")
+	write.begin(&writeConn)
+	write.end(HandleWriteRequest(write, &bufferWriter{}, DefaultTimeouts, testLogger))
+	auditLog.Close()
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 audit records, got %d", len(lines))
+	}
+	var records [2]audit.Record
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &records[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r := records[0]; r.Outcome != audit.OutcomeCompleted || r.Direction != directionRead || r.Filename != "test.txt" ||
+		r.Mode != "octet" || r.Bytes != 4 || r.Retransmits != 1 || r.ErrorCode != nil {
+		t.Errorf("Unexpected read record: %+v", r)
+	}
+	if r := records[1]; r.Outcome != audit.OutcomeFailed || r.Direction != directionWrite || r.Bytes != 512 ||
+		r.ErrorCode == nil || *r.ErrorCode != 3 || r.Error != "test" {
+		t.Errorf("Unexpected write record: %+v", r)
+	}
+}
+
+func assertMetric(t *testing.T, reg *metrics.Registry, expected string) {
+	t.Helper()
+	var out bytes.Buffer
+	reg.WriteTo(&out)
+	if !strings.Contains(out.String(), expected+"\n") {
+		t.Errorf("Expected %s in:\n%s", expected, out.String())
+	}
+}
+
+func TestTransfer_ListedWhileActive(t *testing.T) {
+	server := New(0, 0)
+	dummyConn := NewDummyPacketConn("TestTransfer_ListedWhileActive")
+	sut := server.newTransfer("client", directionWrite, "test.txt", "octet")
+	sut.begin(&dummyConn)
+	sut.Read(time.Second)
+	sut.Read(time.Second)
+
+	transfers := server.Transfers()
+	if len(transfers) != 1 || transfers[0].Session != sut.session || transfers[0].Filename != "test.txt" ||
+		transfers[0].Direction != directionWrite {
+		t.Fatalf("Expected the transfer to be listed: %+v", transfers)
+	}
+
+	sut.end(false)
+	if transfers := server.Transfers(); len(transfers) != 0 {
+		t.Errorf("Expected no transfers once ended: %+v", transfers)
+	}
+}
+
+func TestTransfer_Cancel(t *testing.T) {
+	server := New(0, 0)
+	dummyConn := NewDummyPacketConn("TestTransfer_Cancel", packets.NewAck(1))
+	sut := server.newTransfer("client", directionRead, "test.txt", "octet")
+	sut.begin(&dummyConn)
+
+	if err := server.CancelTransfer(sut.session); err != nil {
+		t.Fatal(err)
+	}
+	if HandleReadRequest(sut, bytes.NewReader([]byte("test")), DefaultTimeouts, testLogger) {
+		t.Error("Expected a cancelled transfer to fail")
+	}
+	sut.end(false)
+
+	assertNumSent(t, dummyConn.packetWritten, 1)
+	assertErrorPacket(t, dummyConn.packetWritten.Front(), 0, "Transfer cancelled")
+	if err := server.CancelTransfer(sut.session); err != ErrNoSuchTransfer {
+		t.Errorf("Expected ErrNoSuchTransfer once ended, got %v", err)
+	}
+}
+
+func TestTransfer_MaxSessions(t *testing.T) {
+	server := New(0, 0, WithMaxSessions(1))
+	server.store.Put("test.txt", []byte("test"))
+	activeConn := NewDummyPacketConn("TestTransfer_MaxSessions")
+	active := server.newTransfer("client", directionRead, "test.txt", "octet")
+	active.begin(&activeConn)
+	if server.HasCapacity() {
+		t.Error("Expected no capacity with a transfer in progress")
+	}
+
+	replyConn := NewDummyPacketConn("TestTransfer_MaxSessions")
+	server.onReadRequest(&replyConn, packets.ReadPacket{Filename: "test.txt", Mode: "octet"}, &net.UDPAddr{})
+
+	assertNumSent(t, replyConn.packetWritten, 1)
+	assertErrorPacket(t, replyConn.packetWritten.Front(), 0, "Server busy, try again later")
+	active.end(true)
+	if !server.HasCapacity() {
+		t.Error("Expected capacity once the transfer ended")
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"errors"
+	"github.com/sblundy/inmemorytftp/server/packets"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNoSuchTransfer is returned when cancelling a transfer that isn't in progress
+var ErrNoSuchTransfer = errors.New("no such transfer")
+
+// cancelledError is sent to the client of a cancelled transfer
+var cancelledError = packets.NewError(0, "Transfer cancelled")
+
+// TransferInfo describes a transfer in progress
+type TransferInfo struct {
+	Session   uint64 `json:"session"`
+	Client    string `json:"client"`
+	Direction string `json:"direction"`
+	Filename  string `json:"filename"`
+	Mode      string `json:"mode"`
+	// Block is the last block sent, for a read, or received, for a write
+	Block       uint16    `json:"block"`
+	Bytes       int64     `json:"bytes"`
+	Retransmits int       `json:"retransmits"`
+	Started     time.Time `json:"started"`
+}
+
+// activeTransfers holds the transfers in progress, by session id
+type activeTransfers struct {
+	lock      sync.Mutex
+	transfers map[uint64]*transfer
+	// starting counts the transfers that have reserved a place but aren't in transfers yet
+	starting int
+}
+
+// reserve holds a place for a transfer that's starting, unless max transfers are already in progress or starting. A
+// max of 0 is no limit.
+func (a *activeTransfers) reserve(max int) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if max > 0 && len(a.transfers)+a.starting >= max {
+		return false
+	}
+	a.starting++
+	return true
+}
+
+func (a *activeTransfers) unreserve() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.starting--
+}
+
+func (a *activeTransfers) hasCapacity(max int) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return max <= 0 || len(a.transfers)+a.starting < max
+}
+
+func (a *activeTransfers) add(t *transfer) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.transfers[t.session] = t
+}
+
+func (a *activeTransfers) remove(t *transfer) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.transfers, t.session)
+}
+
+func (a *activeTransfers) get(session uint64) (*transfer, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	t, prs := a.transfers[session]
+	return t, prs
+}
+
+// Transfers returns the transfers in progress, oldest first
+func (server *TftpServer) Transfers() []TransferInfo {
+	server.active.lock.Lock()
+	transfers := make([]*transfer, 0, len(server.active.transfers))
+	for _, t := range server.active.transfers {
+		transfers = append(transfers, t)
+	}
+	server.active.lock.Unlock()
+
+	infos := make([]TransferInfo, len(transfers))
+	for i, t := range transfers {
+		infos[i] = t.info()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Session < infos[j].Session
+	})
+	return infos
+}
+
+// CancelTransfer aborts the transfer with the given session id, sending the client an ERROR packet. It returns
+// ErrNoSuchTransfer if the transfer has already ended.
+func (server *TftpServer) CancelTransfer(session uint64) error {
+	t, prs := server.active.get(session)
+	if !prs {
+		return ErrNoSuchTransfer
+	}
+	t.cancel()
+	return nil
+}
+
+func (t *transfer) info() TransferInfo {
+	t.progress.Lock()
+	defer t.progress.Unlock()
+	return TransferInfo{
+		Session:     t.session,
+		Client:      t.client,
+		Direction:   t.direction,
+		Filename:    t.filename,
+		Mode:        t.mode,
+		Block:       t.block,
+		Bytes:       t.bytes,
+		Retransmits: t.retransmits,
+		Started:     t.start,
+	}
+}
+
+// cancel tells the client the transfer is over and closes the connection, so a handler waiting on a packet stops
+// waiting. The handler is then given cancelledError as though the client had sent it, so it ends the transfer as it
+// would any other aborted by the client.
+func (t *transfer) cancel() {
+	t.cancelOnce.Do(func() {
+		t.logger.Warn("Transfer cancelled")
+		t.dataSpan.AddEvent("cancelled")
+		t.server.metrics.errorsSent.With("0").Inc()
+		t.TftpPacketConn.Write(cancelledError)
+		close(t.cancelled)
+		t.TftpPacketConn.Close()
+	})
+}
+
+func (t *transfer) isCancelled() bool {
+	select {
+	case <-t.cancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *transfer) readCancelled() (packets.Packet, bool) {
+	p := cancelledError
+	t.errPacket = &p
+	return cancelledError, true
+}
@@ -0,0 +1,215 @@
+package watch
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/sblundy/inmemorytftp/server/preload"
+	"github.com/sblundy/inmemorytftp/server/store"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Watcher keeps the store in sync with a directory, after it has been loaded by preload.Load. Files are only stored
+// once they've gone unchanged for the debounce period, so a file still being written isn't served.
+type Watcher struct {
+	dir      string
+	files    store.Store
+	opts     preload.Options
+	debounce time.Duration
+	fsw      *fsnotify.Watcher
+	// pending holds a timer for each file waiting out the debounce period, keyed by full path
+	pending map[string]*time.Timer
+	ready   chan string
+	// known holds the filenames this watcher has put in the store, so they can be removed with their directory
+	known map[string]bool
+	done  chan bool
+}
+
+// Start begins watching dir and every directory under it.
+func Start(dir string, files store.Store, opts preload.Options, debounce time.Duration) (*Watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	watcher := &Watcher{
+		dir:      dir,
+		files:    files,
+		opts:     opts,
+		debounce: debounce,
+		fsw:      fsw,
+		pending:  make(map[string]*time.Timer),
+		ready:    make(chan string),
+		known:    make(map[string]bool),
+		done:     make(chan bool),
+	}
+	if err := watcher.addTree(dir, false); err != nil {
+		fsw.Close()
+		return nil, err
+	}
+	go watcher.run()
+	return watcher, nil
+}
+
+// Stop ends watching. Changes still waiting out the debounce period are dropped.
+func (watcher *Watcher) Stop() {
+	close(watcher.done)
+	watcher.fsw.Close()
+}
+
+func (watcher *Watcher) run() {
+	for {
+		select {
+		case <-watcher.done:
+			for _, timer := range watcher.pending {
+				timer.Stop()
+			}
+			return
+		case event, ok := <-watcher.fsw.Events:
+			if !ok {
+				return
+			}
+			watcher.onEvent(event)
+		case err, ok := <-watcher.fsw.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("Error watching directory", "dir", watcher.dir, "error", err)
+		case fullPath := <-watcher.ready:
+			delete(watcher.pending, fullPath)
+			watcher.store(fullPath)
+		}
+	}
+}
+
+func (watcher *Watcher) onEvent(event fsnotify.Event) {
+	switch {
+	case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+		// A rename is reported against the old name. If it was moved within the tree, a create follows for the new name
+		watcher.cancel(event.Name)
+		watcher.removeTree(event.Name)
+	case event.Has(fsnotify.Create):
+		info, err := os.Stat(event.Name)
+		if err != nil {
+			return
+		}
+		if info.IsDir() {
+			if err := watcher.addTree(event.Name, true); err != nil {
+				slog.Error("Unable to watch", "path", event.Name, "error", err)
+			}
+		} else {
+			watcher.schedule(event.Name)
+		}
+	case event.Has(fsnotify.Write):
+		watcher.schedule(event.Name)
+	}
+}
+
+// schedule (re)starts the debounce timer for a file
+func (watcher *Watcher) schedule(fullPath string) {
+	if _, ok := watcher.opts.Filename(watcher.dir, fullPath); !ok {
+		return
+	}
+	if timer, ok := watcher.pending[fullPath]; ok {
+		timer.Stop()
+	}
+	watcher.pending[fullPath] = time.AfterFunc(watcher.debounce, func() {
+		select {
+		case watcher.ready <- fullPath:
+		case <-watcher.done:
+		}
+	})
+}
+
+func (watcher *Watcher) cancel(fullPath string) {
+	for pendingPath, timer := range watcher.pending {
+		if pendingPath == fullPath || strings.HasPrefix(pendingPath, fullPath+string(filepath.Separator)) {
+			timer.Stop()
+			delete(watcher.pending, pendingPath)
+		}
+	}
+}
+
+func (watcher *Watcher) store(fullPath string) {
+	filename, ok := watcher.opts.Filename(watcher.dir, fullPath)
+	if !ok {
+		return
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		// Removed again before the debounce period ended
+		return
+	}
+	if !info.Mode().IsRegular() {
+		return
+	}
+	if watcher.opts.MaxSize > 0 && info.Size() > watcher.opts.MaxSize {
+		slog.Warn("Skipping file larger than limit", "path", fullPath, "size", info.Size())
+		watcher.remove(filename)
+		return
+	}
+	contents, err := os.ReadFile(fullPath)
+	if err != nil {
+		slog.Warn("Unable to read", "path", fullPath, "error", err)
+		return
+	}
+	if err := watcher.files.Put(filename, contents); err != nil {
+		slog.Error("Unable to store", "filename", filename, "error", err)
+		return
+	}
+	watcher.known[filename] = true
+	slog.Info("Stored", "filename", filename, "path", fullPath)
+}
+
+func (watcher *Watcher) remove(filename string) {
+	if !watcher.known[filename] {
+		return
+	}
+	delete(watcher.known, filename)
+	if _, err := watcher.files.Delete(filename); err != nil {
+		slog.Error("Unable to remove", "filename", filename, "error", err)
+	} else {
+		slog.Info("Removed", "filename", filename)
+	}
+}
+
+// removeTree removes the file at fullPath, or every file under it if it was a directory
+func (watcher *Watcher) removeTree(fullPath string) {
+	rel, err := filepath.Rel(watcher.dir, fullPath)
+	if err != nil {
+		return
+	}
+	prefix := filepath.ToSlash(rel)
+	for filename := range watcher.known {
+		if filename == prefix || strings.HasPrefix(filename, prefix+"/") {
+			watcher.remove(filename)
+		}
+	}
+}
+
+// addTree watches root and every directory under it. When scheduleFiles is set, the files found are stored too. This
+// covers files written into a new directory before it was being watched.
+func (watcher *Watcher) addTree(root string, scheduleFiles bool) error {
+	return filepath.WalkDir(root, func(fullPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if fullPath == root {
+				return err
+			}
+			slog.Warn("Unable to read", "path", fullPath, "error", err)
+			return nil
+		}
+		if entry.IsDir() {
+			return watcher.fsw.Add(fullPath)
+		}
+		if filename, ok := watcher.opts.Filename(watcher.dir, fullPath); ok {
+			// Files already loaded by preload.Load are managed by this watcher from now on
+			watcher.known[filename] = true
+			if scheduleFiles {
+				watcher.schedule(fullPath)
+			}
+		}
+		return nil
+	})
+}
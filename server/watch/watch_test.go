@@ -0,0 +1,114 @@
+package watch
+
+import (
+	"bytes"
+	"github.com/sblundy/inmemorytftp/server/preload"
+	"github.com/sblundy/inmemorytftp/server/store"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testDebounce = 50 * time.Millisecond
+
+func TestWatcher_AddReplaceRemove(t *testing.T) {
+	dir := t.TempDir()
+	files := store.New()
+	sut := startTestWatcher(t, dir, files)
+	defer sut.Stop()
+
+	writeTestFile(t, dir, "kernel.img", "first")
+	waitFor(t, func() bool { return stored(files, "kernel.img", "first") })
+
+	writeTestFile(t, dir, "kernel.img", "second")
+	waitFor(t, func() bool { return stored(files, "kernel.img", "second") })
+
+	os.Remove(filepath.Join(dir, "kernel.img"))
+	waitFor(t, func() bool { return missing(files, "kernel.img") })
+}
+
+func TestWatcher_NewDirectory(t *testing.T) {
+	dir := t.TempDir()
+	files := store.New()
+	sut := startTestWatcher(t, dir, files)
+	defer sut.Stop()
+
+	writeTestFile(t, dir, "images/kernel.img", "kernel")
+	waitFor(t, func() bool { return stored(files, "images/kernel.img", "kernel") })
+
+	os.RemoveAll(filepath.Join(dir, "images"))
+	waitFor(t, func() bool { return missing(files, "images/kernel.img") })
+}
+
+func TestWatcher_RemovesPreloadedFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "kernel.img", "kernel")
+	files := store.New()
+	preload.Load(dir, files, preload.Options{})
+	sut := startTestWatcher(t, dir, files)
+	defer sut.Stop()
+
+	os.Remove(filepath.Join(dir, "kernel.img"))
+	waitFor(t, func() bool { return missing(files, "kernel.img") })
+}
+
+func TestWatcher_Excluded(t *testing.T) {
+	dir := t.TempDir()
+	files := store.New()
+	sut, err := Start(dir, files, preload.Options{Exclude: []string{"*.tmp"}}, testDebounce)
+	if err != nil {
+		t.Fatal("Unable to start watcher", err)
+	}
+	defer sut.Stop()
+
+	writeTestFile(t, dir, "kernel.tmp", "partial")
+	writeTestFile(t, dir, "kernel.img", "kernel")
+	waitFor(t, func() bool { return stored(files, "kernel.img", "kernel") })
+
+	if !missing(files, "kernel.tmp") {
+		t.Error("Excluded file stored")
+	}
+}
+
+func startTestWatcher(t *testing.T, dir string, files store.Store) *Watcher {
+	t.Helper()
+	watcher, err := Start(dir, files, preload.Options{}, testDebounce)
+	if err != nil {
+		t.Fatal("Unable to start watcher", err)
+	}
+	return watcher
+}
+
+func writeTestFile(t *testing.T, dir string, name string, contents string) {
+	t.Helper()
+	fullPath := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fullPath, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func stored(files store.Store, filename string, expected string) bool {
+	contents, prs := files.Get(filename)
+	return prs && bytes.Equal(contents, []byte(expected))
+}
+
+func missing(files store.Store, filename string) bool {
+	_, prs := files.Get(filename)
+	return !prs
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for the store to be updated")
+}
@@ -0,0 +1,243 @@
+// Package webhook POSTs a JSON notification to a set of URLs whenever the TFTP server stores an upload.
+//
+// Each notification is signed with an HMAC-SHA256 of the body, given in the header
+//
+//	X-InMemoryTFTP-Signature: sha256=<hex digest>
+//
+// so receivers can check it came from the server. Failed deliveries are retried with exponential backoff.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sblundy/inmemorytftp/server"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const SignatureHeader = "X-InMemoryTFTP-Signature"
+
+// queueSize is the number of notifications held for each URL while earlier ones are delivered. Once full, further
+// notifications to that URL are dropped
+const queueSize = 256
+
+// Payload is the JSON body POSTed for each upload
+type Payload struct {
+	Event    server.EventType `json:"event"`
+	Time     time.Time        `json:"time"`
+	Filename string           `json:"filename"`
+	Size     int64            `json:"size"`
+	SHA256   string           `json:"sha256"`
+	Version  int              `json:"version"`
+	// Uploader is the address of the client that uploaded the file
+	Uploader string `json:"uploader"`
+}
+
+// Notifier delivers notifications to each URL in the order the uploads were stored. Pass its Observe method to
+// server.WithObserver.
+type Notifier struct {
+	secret   []byte
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+	targets  []*target
+	// ctx is cancelled to abandon deliveries still being retried on shutdown
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+	// lock guards stopped, so nothing is queued once the queues are closed
+	lock    sync.RWMutex
+	stopped bool
+}
+
+type target struct {
+	url   string
+	queue chan []byte
+}
+
+// Option customises a Notifier created by New
+type Option func(*Notifier)
+
+// WithSecret signs each notification with secret. Without it, notifications aren't signed.
+func WithSecret(secret string) Option {
+	return func(n *Notifier) {
+		n.secret = []byte(secret)
+	}
+}
+
+// WithRetries makes up to attempts tries at each delivery, waiting backoff before the first retry and doubling the
+// wait each time after. Defaults to 5 attempts, starting at 1s.
+func WithRetries(attempts int, backoff time.Duration) Option {
+	return func(n *Notifier) {
+		n.attempts = attempts
+		n.backoff = backoff
+	}
+}
+
+// WithClient sends notifications with client rather than one with a 10s timeout.
+func WithClient(client *http.Client) Option {
+	return func(n *Notifier) {
+		n.client = client
+	}
+}
+
+// New starts delivering notifications to urls. Shutdown must be called to stop it.
+func New(urls []string, opts ...Option) *Notifier {
+	n := &Notifier{
+		client:   &http.Client{Timeout: 10 * time.Second},
+		attempts: 5,
+		backoff:  time.Second,
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	if n.attempts < 1 {
+		n.attempts = 1
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	for _, url := range urls {
+		t := &target{url: url, queue: make(chan []byte, queueSize)}
+		n.targets = append(n.targets, t)
+		n.workers.Add(1)
+		go n.deliverAll(t)
+	}
+	return n
+}
+
+// Observe queues a notification for each URL if event is an upload being stored, ignoring any other event. It
+// doesn't wait for the notifications to be delivered.
+func (n *Notifier) Observe(event server.Event) {
+	if event.Type != server.EventFileStored {
+		return
+	}
+	body, err := json.Marshal(Payload{
+		Event:    event.Type,
+		Time:     event.Time,
+		Filename: event.Filename,
+		Size:     event.Bytes,
+		SHA256:   event.SHA256,
+		Version:  event.Version,
+		Uploader: event.Client,
+	})
+	if err != nil {
+		slog.Error("Unable to encode webhook", "filename", event.Filename, "error", err)
+		return
+	}
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	if n.stopped {
+		slog.Warn("Webhooks shut down, dropping notification", "filename", event.Filename)
+		return
+	}
+	for _, t := range n.targets {
+		select {
+		case t.queue <- body:
+		default:
+			slog.Warn("Webhook queue full, dropping notification", "url", t.url, "filename", event.Filename)
+		}
+	}
+}
+
+// Shutdown stops accepting notifications and waits for those queued to be delivered. If ctx is done first, the
+// remaining deliveries are abandoned.
+func (n *Notifier) Shutdown(ctx context.Context) error {
+	n.lock.Lock()
+	if !n.stopped {
+		n.stopped = true
+		for _, t := range n.targets {
+			close(t.queue)
+		}
+	}
+	n.lock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		n.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		n.cancel()
+		return nil
+	case <-ctx.Done():
+		n.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (n *Notifier) deliverAll(t *target) {
+	defer n.workers.Done()
+	for body := range t.queue {
+		n.deliver(t.url, body)
+	}
+}
+
+// deliver POSTs body to url, retrying until it's accepted, the attempts run out or the notifier is shut down
+func (n *Notifier) deliver(url string, body []byte) {
+	wait := n.backoff
+	for attempt := 1; ; attempt++ {
+		err := n.post(url, body)
+		if err == nil {
+			return
+		}
+		if _, permanent := err.(permanentError); permanent || attempt >= n.attempts {
+			slog.Error("Unable to deliver webhook", "url", url, "attempts", attempt, "error", err)
+			return
+		}
+		slog.Warn("Webhook delivery failed, retrying", "url", url, "attempt", attempt, "retryIn", wait, "error", err)
+		select {
+		case <-time.After(wait):
+		case <-n.ctx.Done():
+			slog.Error("Webhook abandoned on shutdown", "url", url, "attempts", attempt)
+			return
+		}
+		wait *= 2
+	}
+}
+
+// permanentError is a failure that retrying won't fix, such as the receiver rejecting the request
+type permanentError struct {
+	status string
+}
+
+func (e permanentError) Error() string {
+	return "rejected: " + e.status
+}
+
+func (n *Notifier) post(url string, body []byte) error {
+	req, err := http.NewRequestWithContext(n.ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{status: err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != nil {
+		req.Header.Set(SignatureHeader, Sign(n.secret, body))
+	}
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode < 300:
+		return nil
+	case res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusRequestTimeout:
+		return fmt.Errorf("server error: %s", res.Status)
+	default:
+		return permanentError{status: res.Status}
+	}
+}
+
+// Sign returns the value of the signature header for body
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,106 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/sblundy/inmemorytftp/server"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type receiver struct {
+	lock     sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	status := http.StatusOK
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func stored(filename string) server.Event {
+	return server.Event{Type: server.EventFileStored, Time: time.Now(), Client: "10.0.0.1:1234", Filename: filename,
+		Bytes: 6, SHA256: "abc", Version: 2}
+}
+
+func TestNotifier_Delivers(t *testing.T) {
+	r := &receiver{}
+	hook := httptest.NewServer(r)
+	defer hook.Close()
+	sut := New([]string{hook.URL}, WithSecret("secret"))
+
+	sut.Observe(server.Event{Type: server.EventTransferStarted, Filename: "ignored.cfg"})
+	sut.Observe(stored("switch.cfg"))
+	sut.Shutdown(context.Background())
+
+	if len(r.bodies) != 1 {
+		t.Fatalf("Expected 1 notification, got %d", len(r.bodies))
+	}
+	var payload Payload
+	if err := json.Unmarshal(r.bodies[0], &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Filename != "switch.cfg" || payload.Size != 6 || payload.SHA256 != "abc" || payload.Version != 2 ||
+		payload.Uploader != "10.0.0.1:1234" || payload.Event != server.EventFileStored {
+		t.Errorf("Unexpected payload: %+v", payload)
+	}
+	if sig := r.requests[0].Header.Get(SignatureHeader); sig != Sign([]byte("secret"), r.bodies[0]) {
+		t.Errorf("Unexpected signature %q", sig)
+	}
+}
+
+func TestNotifier_Retries(t *testing.T) {
+	r := &receiver{statuses: []int{http.StatusInternalServerError, http.StatusServiceUnavailable}}
+	hook := httptest.NewServer(r)
+	defer hook.Close()
+	sut := New([]string{hook.URL}, WithRetries(3, time.Millisecond))
+
+	sut.Observe(stored("switch.cfg"))
+	sut.Shutdown(context.Background())
+
+	if len(r.bodies) != 3 {
+		t.Errorf("Expected 3 attempts, got %d", len(r.bodies))
+	}
+}
+
+func TestNotifier_GivesUp(t *testing.T) {
+	r := &receiver{statuses: []int{http.StatusBadRequest}}
+	hook := httptest.NewServer(r)
+	defer hook.Close()
+	sut := New([]string{hook.URL}, WithRetries(3, time.Millisecond))
+
+	sut.Observe(stored("switch.cfg"))
+	sut.Shutdown(context.Background())
+
+	if len(r.bodies) != 1 {
+		t.Errorf("Expected a rejected notification not to be retried, got %d attempts", len(r.bodies))
+	}
+}
+
+func TestNotifier_ShutdownAbandonsRetries(t *testing.T) {
+	r := &receiver{statuses: []int{http.StatusInternalServerError}}
+	hook := httptest.NewServer(r)
+	defer hook.Close()
+	sut := New([]string{hook.URL}, WithRetries(3, time.Hour))
+
+	sut.Observe(stored("switch.cfg"))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sut.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected shutdown to time out, got %v", err)
+	}
+}
@@ -1,43 +1,95 @@
 package server
 
 import (
-	"bytes"
-	"fmt"
+	"errors"
 	"github.com/sblundy/inmemorytftp/server/connection"
 	"github.com/sblundy/inmemorytftp/server/packets"
-	"log"
-	"os"
+	"github.com/sblundy/inmemorytftp/server/store"
+	"io"
+	"log/slog"
 	"time"
 )
 
-const writeBlockTimeout = 30 * time.Second
+// FileWriter receives an upload as its blocks arrive. Commit is called once the last block has arrived, and Abort if the
+// upload fails before then.
+type FileWriter interface {
+	io.Writer
+	Commit() error
+	Abort()
+}
 
-func HandleWriteRequest(conn connection.TftpPacketConn, filename string) ([]byte, bool) {
-	logger := log.New(os.Stdout, fmt.Sprintf("TftpServer.WriteRequest(%s->%s) ", conn.RemoteAddr(), conn.LocalAddr()), log.LstdFlags)
-	logger.Println("Start write", filename)
+// HandleWriteRequest receives a file from the client, writing each block to w as it arrives. The final ACK is only sent
+// if w.Commit succeeds, so the client is never told a file was stored when it wasn't. If w.Write fails, the upload is
+// stopped straight away rather than once every block has been sent.
+func HandleWriteRequest(conn connection.TftpPacketConn, w FileWriter, timeouts Timeouts, logger *slog.Logger) bool {
+	logger.Info("Start write")
 	conn.Write(packets.NewAck(0))
-	buff := bytes.NewBuffer([]byte{})
+	counter := &countingWriter{w: w}
 	var block uint16 = 1
-	nextBlockDeadline := time.Now().Add(writeBlockTimeout)
+	nextBlockDeadline := time.Now().Add(timeouts.Block)
+	retry := 0
 	for time.Now().Before(nextBlockDeadline) {
-		switch readPacket(buff, conn, block) {
+		switch readPacket(counter, conn, block, timeouts) {
 		case NormalTermination:
-			logger.Println("End write", filename, len(buff.Bytes()))
-			return buff.Bytes(), true
+			if err := w.Commit(); err != nil {
+				logger.Error("End write: commit failed", "block", block, "error", err)
+				conn.Write(storeError(err))
+				return false
+			}
+			conn.Write(packets.NewAck(block))
+			logger.Info("End write", "blocks", block, "bytes", counter.n)
+			return true
 		case PrematureTerminate:
-			logger.Println("WARN: Write terminated", filename)
-			return nil, false
+			logger.Warn("End write: terminated by client", "block", block)
+			w.Abort()
+			return false
+		case StoreFailed:
+			logger.Error("End write: write failed", "block", block, "error", counter.err)
+			conn.Write(storeError(counter.err))
+			w.Abort()
+			return false
 		case BlockReceived:
 			block++
 			// Each time a block is received, update the timeout
-			nextBlockDeadline = time.Now().Add(writeBlockTimeout)
+			nextBlockDeadline = time.Now().Add(timeouts.Block)
+			retry = 0
 		case BlockBotReceived:
-
+			retry++
+			if timeouts.retriesExhausted(retry) {
+				logger.Error("End write: retries exhausted", "block", block, "retries", timeouts.Retries)
+				w.Abort()
+				return false
+			}
 		}
 	}
 
-	logger.Println("ERROR: End write:timed out", filename)
-	return nil, false
+	logger.Error("End write: timed out", "block", block)
+	w.Abort()
+	return false
+}
+
+// storeError is the ERROR packet telling the client why its upload couldn't be stored
+func storeError(err error) packets.ErrorPacket {
+	if errors.Is(err, store.ErrTooLarge) {
+		return packets.NewError(3, "Disk full or allocation exceeded")
+	}
+	return packets.NewError(0, "Unable to store file")
+}
+
+// countingWriter counts the bytes written, and remembers the error that stopped the upload
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	if err != nil {
+		cw.err = err
+	}
+	return n, err
 }
 
 type readOutcome int
@@ -48,10 +100,11 @@ const (
 	PrematureTerminate
 	BlockReceived
 	BlockBotReceived
+	StoreFailed
 )
 
-func readPacket(buff *bytes.Buffer, conn connection.TftpPacketConn, block uint16) readOutcome {
-	packet, ok := conn.Read(2 * time.Second)
+func readPacket(w io.Writer, conn connection.TftpPacketConn, block uint16, timeouts Timeouts) readOutcome {
+	packet, ok := conn.Read(timeouts.Data)
 	if !ok {
 		//Re-acknowledging the previous block in case that ACK was lost
 		conn.Write(packets.NewAck(block - 1))
@@ -63,12 +116,14 @@ func readPacket(buff *bytes.Buffer, conn connection.TftpPacketConn, block uint16
 	case packets.DataPacket:
 		data := packet.(packets.DataPacket)
 		if block == data.Block {
-			buff.Write(data.Data)
-			conn.Write(packets.NewAck(block))
+			if _, err := w.Write(data.Data); err != nil {
+				return StoreFailed
+			}
 			if len(data.Data) < MaxPayloadSize {
-				//All done
+				//All done. The final ACK is sent once the file is committed
 				return NormalTermination
 			}
+			conn.Write(packets.NewAck(block))
 			return BlockReceived
 		} else if data.Block < block {
 			//Re-acknowledging the previous block in case that ACK was lost
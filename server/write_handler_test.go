@@ -3,7 +3,9 @@ package server
 import (
 	"bytes"
 	"container/list"
+	"errors"
 	"github.com/sblundy/inmemorytftp/server/packets"
+	"github.com/sblundy/inmemorytftp/server/store"
 	"strings"
 	"testing"
 )
@@ -11,7 +13,8 @@ import (
 func TestHandleWriteRequest_EmptyFile(t *testing.T) {
 	dummyConn := NewDummyPacketConn("TestHandleWriteRequest_EmptyFile", packets.NewData(1, []byte{}))
 
-	output, ok := HandleWriteRequest(&dummyConn, "test.txt")
+	output := &bufferWriter{}
+	ok := HandleWriteRequest(&dummyConn, output, DefaultTimeouts, testLogger)
 
 	assertSuccess(t, ok, output, []byte{})
 	assertNumSent(t, dummyConn.packetWritten, 2)
@@ -25,7 +28,8 @@ func TestHandleWriteRequest_FileOfPacketLength(t *testing.T) {
 		packets.NewData(1, fileContents),
 		packets.NewData(2, []byte{}))
 
-	output, ok := HandleWriteRequest(&dummyConn, "test.txt")
+	output := &bufferWriter{}
+	ok := HandleWriteRequest(&dummyConn, output, DefaultTimeouts, testLogger)
 
 	assertSuccess(t, ok, output, fileContents)
 	assertNumSent(t, dummyConn.packetWritten, 3)
@@ -41,23 +45,48 @@ func TestHandleWriteRequest_Timeout(t *testing.T) {
 	dummyConn := NewDummyPacketConn("TestHandleWriteRequest_Timeout",
 		packets.NewData(1, fileContents))
 
-	_, ok := HandleWriteRequest(&dummyConn, "test.txt")
+	output := &bufferWriter{}
+	ok := HandleWriteRequest(&dummyConn, output, DefaultTimeouts, testLogger)
 
 	if ok {
 		t.Error("Expected to fail")
 	}
+	if !output.aborted {
+		t.Error("Expected upload to be aborted")
+	}
 
 	assertAckPacket(t, dummyConn.packetWritten.Front(), 0)
 	assertAckPacket(t, dummyConn.packetWritten.Back(), 1)
 }
 
+func TestHandleWriteRequest_RetriesExhausted(t *testing.T) {
+	fileContents := []byte(strings.Repeat("12345678", 64))
+	dummyConn := NewDummyPacketConn("TestHandleWriteRequest_RetriesExhausted",
+		packets.NewData(1, fileContents))
+	timeouts := DefaultTimeouts
+	timeouts.Retries = 2
+
+	output := &bufferWriter{}
+	ok := HandleWriteRequest(&dummyConn, output, timeouts, testLogger)
+
+	if ok {
+		t.Error("Expected to fail")
+	}
+	if !output.aborted {
+		t.Error("Expected upload to be aborted")
+	}
+	// The first ACK, the ACK of block 1, then block 1 acknowledged again on each of the 3 reads that time out
+	assertNumSent(t, dummyConn.packetWritten, 5)
+}
+
 func TestHandleWriteRequest_ResendsAckOnDuplicateData(t *testing.T) {
 	fileContents := []byte(strings.Repeat("12345678", 64))
 	dummyConn := NewDummyPacketConn("TestHandleWriteRequest_EmptyFile", packets.NewData(1, fileContents),
 		packets.NewData(1, fileContents),
 		packets.NewData(2, []byte{}))
 
-	output, ok := HandleWriteRequest(&dummyConn, "test.txt")
+	output := &bufferWriter{}
+	ok := HandleWriteRequest(&dummyConn, output, DefaultTimeouts, testLogger)
 
 	assertSuccess(t, ok, output, fileContents)
 	assertNumSent(t, dummyConn.packetWritten, 4)
@@ -73,20 +102,99 @@ func TestHandleWriteRequest_HandlesPrematureTermination(t *testing.T) {
 		packets.NewData(1, fileContents),
 		packets.NewError(3, "test"))
 
-	_, ok := HandleWriteRequest(&dummyConn, "test.txt")
+	output := &bufferWriter{}
+	ok := HandleWriteRequest(&dummyConn, output, DefaultTimeouts, testLogger)
 
 	if ok {
 		t.Error("Expected to fail")
 	}
+	if !output.aborted {
+		t.Error("Expected upload to be aborted")
+	}
 	assertNumSent(t, dummyConn.packetWritten, 3)
 }
 
-func assertSuccess(t *testing.T, ok bool, contents []byte, expectedContents []byte) {
+func TestHandleWriteRequest_CommitFailed(t *testing.T) {
+	dummyConn := NewDummyPacketConn("TestHandleWriteRequest_CommitFailed", packets.NewData(1, []byte("test")))
+
+	ok := HandleWriteRequest(&dummyConn, &bufferWriter{commitErr: errors.New("test")}, DefaultTimeouts, testLogger)
+
+	if ok {
+		t.Error("Expected to fail")
+	}
+	assertNumSent(t, dummyConn.packetWritten, 2)
+	assertAckPacket(t, dummyConn.packetWritten.Front(), 0)
+	assertErrorPacket(t, dummyConn.packetWritten.Back(), 0, "Unable to store file")
+}
+
+func TestHandleWriteRequest_WriteFailed(t *testing.T) {
+	fileContents := []byte(strings.Repeat("12345678", 64))
+	dummyConn := NewDummyPacketConn("TestHandleWriteRequest_WriteFailed",
+		packets.NewData(1, fileContents),
+		packets.NewData(2, fileContents),
+		packets.NewData(3, []byte{}))
+
+	output := &bufferWriter{writeErr: errors.New("test"), maxSize: len(fileContents)}
+	ok := HandleWriteRequest(&dummyConn, output, DefaultTimeouts, testLogger)
+
+	if ok {
+		t.Error("Expected to fail")
+	}
+	if !output.aborted {
+		t.Error("Expected upload to be aborted")
+	}
+	assertNumSent(t, dummyConn.packetWritten, 3)
+	assertAckPacket(t, dummyConn.packetWritten.Front(), 0)
+	assertAckPacket(t, dummyConn.packetWritten.Front().Next(), 1)
+	assertErrorPacket(t, dummyConn.packetWritten.Back(), 0, "Unable to store file")
+}
+
+// bufferWriter is a FileWriter that holds the upload in memory. Writes beyond maxSize fail with writeErr, if set
+func TestHandleWriteRequest_TooLarge(t *testing.T) {
+	dummyConn := NewDummyPacketConn("TestHandleWriteRequest_TooLarge", packets.NewData(1, []byte("test")))
+
+	output := &bufferWriter{writeErr: store.ErrTooLarge}
+	ok := HandleWriteRequest(&dummyConn, output, DefaultTimeouts, testLogger)
+
+	if ok || !output.aborted {
+		t.Error("Expected upload to be aborted")
+	}
+	assertErrorPacket(t, dummyConn.packetWritten.Back(), 3, "Disk full or allocation exceeded")
+}
+
+type bufferWriter struct {
+	bytes.Buffer
+	maxSize   int
+	writeErr  error
+	commitErr error
+	committed bool
+	aborted   bool
+}
+
+func (w *bufferWriter) Write(p []byte) (int, error) {
+	if w.writeErr != nil && w.Len()+len(p) > w.maxSize {
+		return 0, w.writeErr
+	}
+	return w.Buffer.Write(p)
+}
+
+func (w *bufferWriter) Commit() error {
+	w.committed = w.commitErr == nil
+	return w.commitErr
+}
+
+func (w *bufferWriter) Abort() {
+	w.aborted = true
+}
+
+func assertSuccess(t *testing.T, ok bool, output *bufferWriter, expectedContents []byte) {
 	t.Helper()
 	if !ok {
 		t.Error("Write failed when expected to succeed")
-	} else if !bytes.Equal(contents, expectedContents) {
-		t.Error("Contents not correct", contents)
+	} else if !output.committed {
+		t.Error("Upload not committed")
+	} else if !bytes.Equal(output.Bytes(), expectedContents) {
+		t.Error("Contents not correct", output.Bytes())
 	}
 }
 
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// snapshotSignals trigger an on demand snapshot
+var snapshotSignals = []os.Signal{syscall.SIGUSR1}
+
+// reloadSignals trigger a reload of the configuration
+var reloadSignals = []os.Signal{syscall.SIGHUP}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// snapshotSignals is empty as Windows has no SIGUSR1. Snapshots are only taken on shutdown.
+var snapshotSignals = []os.Signal{}
+
+// reloadSignals is empty as Windows has no SIGHUP. The configuration can still be reloaded through the admin API.
+var reloadSignals = []os.Signal{}